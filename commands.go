@@ -1,10 +1,15 @@
 package graval
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/jehiah/go-strftime"
@@ -13,6 +18,9 @@ import (
 type ftpCommand interface {
 	RequireParam() bool
 	RequireAuth() bool
+	// Syntax describes the parameters of the command for HELP, like
+	// "<path>". Optional parameters are in brackets.
+	Syntax() string
 	Execute(*ftpConn, string) error
 }
 
@@ -20,46 +28,132 @@ type commandMap map[string]ftpCommand
 
 var (
 	commands = commandMap{
-		"ALLO": commandAllo{},
-		"CDUP": commandCdup{},
-		"CWD":  commandCwd{},
-		"DELE": commandDele{},
-		"EPRT": commandEprt{},
-		"EPSV": commandEpsv{},
-		"FEAT": commandFeat{},
-		"LIST": commandList{},
-		"NLST": commandNlst{},
-		"MDTM": commandMdtm{},
-		"MKD":  commandMkd{},
-		"MODE": commandMode{},
-		"NOOP": commandNoop{},
-		"OPTS": commandOpts{},
-		"PASS": commandPass{},
-		"PASV": commandPasv{},
-		"PORT": commandPort{},
-		"PWD":  commandPwd{},
-		"QUIT": commandQuit{},
-		"RETR": commandRetr{},
-		"RNFR": commandRnfr{},
-		"RNTO": commandRnto{},
-		"RMD":  commandRmd{},
-		"SIZE": commandSize{},
-		"STOR": commandStor{},
-		"STRU": commandStru{},
-		"SYST": commandSyst{},
-		"TYPE": commandType{},
-		"USER": commandUser{},
-		"XCUP": commandCdup{},
-		"XCWD": commandCwd{},
-		"XPWD": commandPwd{},
-		"XRMD": commandRmd{},
+		"ABOR":    commandAbor{},
+		"ALLO":    commandAllo{},
+		"AVBL":    commandAvbl{},
+		"CDUP":    commandCdup{},
+		"CWD":     commandCwd{},
+		"DELE":    commandDele{},
+		"EPRT":    commandEprt{},
+		"EPSV":    commandEpsv{},
+		"FEAT":    commandFeat{},
+		"HASH":    commandHash{},
+		"HELP":    commandHelp{},
+		"LIST":    commandList{},
+		"NLST":    commandNlst{},
+		"MDTM":    commandMdtm{},
+		"MFCT":    commandMfct{},
+		"MFMT":    commandMfmt{},
+		"MKD":     commandMkd{},
+		"MODE":    commandMode{},
+		"NOOP":    commandNoop{},
+		"OPTS":    commandOpts{},
+		"PASS":    commandPass{},
+		"PASV":    commandPasv{},
+		"PORT":    commandPort{},
+		"PWD":     commandPwd{},
+		"QUIT":    commandQuit{},
+		"RANG":    commandRang{},
+		"REIN":    commandRein{},
+		"RETR":    commandRetr{},
+		"RNFR":    commandRnfr{},
+		"RNTO":    commandRnto{},
+		"RMD":     commandRmd{},
+		"SITE":    commandSite{},
+		"SIZE":    commandSize{},
+		"STAT":    commandStat{},
+		"STOR":    commandStor{},
+		"STOU":    commandStou{},
+		"STRU":    commandStru{},
+		"SYST":    commandSyst{},
+		"TYPE":    commandType{},
+		"USER":    commandUser{},
+		"XCRC":    commandXHash{algorithm: "CRC32"},
+		"XCUP":    commandCdup{},
+		"XCWD":    commandCwd{},
+		"XMD5":    commandXHash{algorithm: "MD5"},
+		"XPWD":    commandPwd{},
+		"XRMD":    commandRmd{},
+		"XSHA1":   commandXHash{algorithm: "SHA-1"},
+		"XSHA256": commandXHash{algorithm: "SHA-256"},
+		"XSHA512": commandXHash{algorithm: "SHA-512"},
 	}
 
 	// Some FTP clients send flags to the LIST and NLST commands. Server support for these varies,
 	// and implementing them all would be a lot of work with uncertain payoff. For now, we ignore them
 	listFlagsRegexp = `^-[alt]+$`
+
+	// The commands that are executed right away while a transfer is running.
+	// All others wait until the transfer finished, so their replies follow
+	// the reply of the transfer.
+	transferCommands = map[string]bool{
+		"ABOR": true,
+		"NOOP": true,
+		"STAT": true,
+	}
 )
 
+// newCommandMap returns the commands of a server, which are the built-in
+// commands with the custom commands of an application added. Custom commands
+// replace built-in ones with the same verb, a nil command removes it.
+func newCommandMap(custom map[string]FTPCommand) commandMap {
+	serverCommands := make(commandMap, len(commands)+len(custom))
+	for verb, command := range commands {
+		serverCommands[verb] = command
+	}
+	for verb, command := range custom {
+		verb = strings.ToUpper(verb)
+		if command == nil {
+			delete(serverCommands, verb)
+		} else {
+			serverCommands[verb] = customCommand{command}
+		}
+	}
+	return serverCommands
+}
+
+// customCommand adapts an FTPCommand of an application to the built-in
+// commands
+type customCommand struct {
+	FTPCommand
+}
+
+func (cmd customCommand) Execute(conn *ftpConn, param string) error {
+	return cmd.FTPCommand.Execute(conn, param)
+}
+
+// commandAbor responds to the ABOR FTP command. It allows the client to
+// cancel the transfer that is running, as described in RFC 959.
+//
+// The transfer is answered with 426 before ABOR itself is answered with 226.
+type commandAbor struct{}
+
+func (cmd commandAbor) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAbor) Syntax() string {
+	return ""
+}
+
+func (cmd commandAbor) Execute(conn *ftpConn, _ string) error {
+	if transfer := conn.activeTransfer(); transfer != nil {
+		transfer.abort()
+		transfer.wait()
+	} else if conn.dataConn != nil {
+		// a data connection that was opened but not used yet
+		conn.dataConn.Close()
+		conn.dataConn = nil
+	}
+
+	_, err := conn.writeMessage(226, "ABOR command successful")
+	return err
+}
+
 // commandAllo responds to the ALLO FTP command.
 //
 // This is essentially a ping from the client so we just respond with an
@@ -74,11 +168,52 @@ func (cmd commandAllo) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandAllo) Syntax() string {
+	return "<bytes>"
+}
+
 func (cmd commandAllo) Execute(conn *ftpConn, _ string) error {
 	_, err := conn.writeMessage(202, "Obsolete")
 	return err
 }
 
+// commandAvbl responds to the AVBL FTP command, as described in
+// draft-peterson-streamlined-ftp-command-extensions.
+//
+// Reports how many bytes the user may still upload, which is only known when
+// the server enforces quotas.
+type commandAvbl struct{}
+
+func (cmd commandAvbl) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAvbl) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAvbl) Syntax() string {
+	return ""
+}
+
+func (cmd commandAvbl) Execute(conn *ftpConn, _ string) error {
+	var quota *FTPQuota
+	if provider := conn.server.quotaProvider; provider != nil {
+		var err error
+		if quota, err = provider.Quota(conn.user); err != nil {
+			return fmt.Errorf("failed to execute AVBL - %w", err)
+		}
+	}
+
+	if quota == nil || quota.AvailableBytes() < 0 {
+		_, err := conn.writeMessage(550, "Available space unknown")
+		return err
+	}
+
+	_, err := conn.writeMessage(213, strconv.FormatInt(quota.AvailableBytes(), 10))
+	return err
+}
+
 // commandCdup responds to the CDUP FTP command.
 //
 // Allows the client change their current directory to the parent.
@@ -92,6 +227,10 @@ func (cmd commandCdup) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandCdup) Syntax() string {
+	return ""
+}
+
 func (cmd commandCdup) Execute(conn *ftpConn, _ string) error {
 	otherCmd := &commandCwd{}
 	return otherCmd.Execute(conn, "..")
@@ -109,9 +248,13 @@ func (cmd commandCwd) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandCwd) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandCwd) Execute(conn *ftpConn, param string) error {
 	path := conn.buildPath(param)
-	changeDir, err := conn.driver.ChangeDir(path)
+	changeDir, err := conn.driver.ChangeDir(conn.driverPath(path))
 	if err != nil {
 		return fmt.Errorf("failed to execute CWD path: %s - %w", path, err)
 	}
@@ -138,14 +281,31 @@ func (cmd commandDele) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandDele) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandDele) Execute(conn *ftpConn, param string) error {
 	path := conn.buildPath(param)
-	deleteFile, err := conn.driver.DeleteFile(path)
+	if !conn.permitted(PermDelete, path) {
+		return conn.permissionDenied()
+	}
+
+	size, err := conn.usedBytes(path)
+	if err != nil {
+		return fmt.Errorf("failed to execute DELE path: %s - %w", path, err)
+	}
+
+	deleteFile, err := conn.driver.DeleteFile(conn.driverPath(path))
 	if err != nil {
 		return fmt.Errorf("failed to execute DELE path: path - %w", err)
 	}
 
 	if deleteFile {
+		if size >= 0 {
+			conn.addUsage(-size, -1)
+		}
+		conn.notify(FTPEvent{Type: EventDeleted, Path: path})
 		_, err := conn.writeMessage(250, "File deleted")
 		return err
 	} else {
@@ -167,6 +327,10 @@ func (cmd commandEprt) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandEprt) Syntax() string {
+	return "|<protocol>|<address>|<port>|"
+}
+
 func (cmd commandEprt) Execute(conn *ftpConn, param string) error {
 	delimiter := param[0:1]
 	parts := strings.Split(param, delimiter)
@@ -212,6 +376,10 @@ func (cmd commandEpsv) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandEpsv) Syntax() string {
+	return ""
+}
+
 func (cmd commandEpsv) Execute(conn *ftpConn, _ string) error {
 	var errs error
 	socket, err := conn.newPassiveSocket()
@@ -240,16 +408,122 @@ func (cmd commandFeat) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandFeat) Syntax() string {
+	return ""
+}
+
 func (cmd commandFeat) Execute(conn *ftpConn, _ string) error {
-	_, err := conn.writeLines(211,
+	lines := []string{
 		"211-Features supported:",
+		" AVBL",
 		" EPRT",
 		" EPSV",
+		" " + hashFeature(conn.hashAlgorithm),
 		" MDTM",
+	}
+	if _, ok := conn.driver.(FTPCreationTimeDriver); ok {
+		lines = append(lines, " MFCT")
+	}
+	if _, ok := conn.driver.(FTPModifiedTimeDriver); ok {
+		lines = append(lines, " MFMT")
+	}
+	lines = append(lines,
+		" RANG STREAM",
 		" SIZE",
 		" UTF8",
+		" XCRC",
+		" XMD5",
+		" XSHA1",
+		" XSHA256",
+		" XSHA512",
 		"211 End FEAT.",
 	)
+	_, err := conn.writeLines(211, lines...)
+	return err
+}
+
+// commandHash responds to the HASH FTP command, as described in
+// draft-bryan-ftpext-hash. It allows the client to get a hash of a file, or
+// of the range set with RANG, to verify a transfer without downloading the
+// file again. The algorithm is selected with OPTS HASH.
+type commandHash struct{}
+
+func (cmd commandHash) RequireParam() bool {
+	return true
+}
+
+func (cmd commandHash) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandHash) Syntax() string {
+	return "<path>"
+}
+
+func (cmd commandHash) Execute(conn *ftpConn, param string) error {
+	// a range only applies to the next HASH
+	hashRange := conn.hashRange
+	conn.hashRange = nil
+
+	sum, start, end, err := computeHash(conn, "HASH", param, conn.hashAlgorithm, hashRange)
+	if err != nil || sum == "" {
+		return err
+	}
+	_, err = conn.writeMessage(213, fmt.Sprintf("%s %d-%d %s %s", conn.hashAlgorithm, start, end, sum, param))
+	return err
+}
+
+// commandHelp responds to the HELP FTP command.
+//
+// Without a parameter it lists the commands the server understands, with a
+// command as parameter it describes its syntax.
+type commandHelp struct{}
+
+func (cmd commandHelp) RequireParam() bool {
+	return false
+}
+
+func (cmd commandHelp) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandHelp) Syntax() string {
+	return "[<command>]"
+}
+
+func (cmd commandHelp) Execute(conn *ftpConn, param string) error {
+	if param != "" {
+		verb := strings.ToUpper(param)
+		command := conn.server.commands[verb]
+		if command == nil {
+			_, err := conn.writeMessage(502, "Unknown command "+verb)
+			return err
+		}
+		syntax := verb
+		if command.Syntax() != "" {
+			syntax += " " + command.Syntax()
+		}
+		_, err := conn.writeMessage(214, "Syntax: "+syntax)
+		return err
+	}
+
+	verbs := make([]string, 0, len(conn.server.commands))
+	for verb := range conn.server.commands {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+
+	lines := []string{"214-The following commands are recognized:"}
+	for len(verbs) > 0 {
+		n := 8
+		if len(verbs) < n {
+			n = len(verbs)
+		}
+		lines = append(lines, " "+strings.Join(verbs[:n], " "))
+		verbs = verbs[n:]
+	}
+	lines = append(lines, "214 Help OK.")
+	_, err := conn.writeLines(214, lines...)
 	return err
 }
 
@@ -265,23 +539,38 @@ func (cmd commandList) RequireAuth() bool {
 	return true
 }
 
-func (cmd commandList) Execute(conn *ftpConn, param string) error {
-	_, err := conn.writeMessage(150, "Opening ASCII mode data connection for file list")
-	if err != nil {
-		return err
-	}
+func (cmd commandList) Syntax() string {
+	return "[<path>]"
+}
 
+func (cmd commandList) Execute(conn *ftpConn, param string) error {
 	matched, _ := regexp.MatchString(listFlagsRegexp, param)
 	if matched {
 		param = ""
 	}
 	path := conn.buildPath(param)
-	files, err := conn.driver.DirContents(path)
+	if !conn.permitted(PermList, path) {
+		return conn.permissionDenied()
+	}
+	if conn.dataConn == nil {
+		return conn.dataConnMissing()
+	}
+
+	_, err := conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 	if err != nil {
-		return fmt.Errorf("failed to execute LIST path: %s - %w", path, err)
+		return err
 	}
-	formatter := newListFormatter(files)
-	return conn.sendOutOfBandData(formatter.Detailed())
+
+	conn.startTransfer("LIST", path, func(transfer *ftpTransfer) error {
+		files, err := conn.driver.DirContents(conn.driverPath(path))
+		if err != nil {
+			return fmt.Errorf("failed to execute LIST path: %s - %w", path, err)
+		}
+		files = conn.hidePendingUploads(path, files)
+		formatter := newListFormatter(files)
+		return conn.sendOutOfBandData(transfer, formatter.Detailed())
+	})
+	return nil
 }
 
 // commandNlst responds to the NLST FTP command. It allows the client to
@@ -296,27 +585,46 @@ func (cmd commandNlst) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandNlst) Syntax() string {
+	return "[<path>]"
+}
+
 func (cmd commandNlst) Execute(conn *ftpConn, param string) error {
-	_, err := conn.writeMessage(150, "Opening ASCII mode data connection for file list")
-	if err != nil {
-		return err
-	}
 	matched, _ := regexp.MatchString(listFlagsRegexp, param)
 	if matched {
 		param = ""
 	}
 	path := conn.buildPath(param)
-	files, err := conn.driver.DirContents(path)
+	if !conn.permitted(PermList, path) {
+		return conn.permissionDenied()
+	}
+	if conn.dataConn == nil {
+		return conn.dataConnMissing()
+	}
+
+	_, err := conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 	if err != nil {
-		return fmt.Errorf("failed to execute NLST path: %s - %w", path, err)
+		return err
 	}
 
-	formatter := newListFormatter(files)
-	return conn.sendOutOfBandData(formatter.Short())
+	conn.startTransfer("NLST", path, func(transfer *ftpTransfer) error {
+		files, err := conn.driver.DirContents(conn.driverPath(path))
+		if err != nil {
+			return fmt.Errorf("failed to execute NLST path: %s - %w", path, err)
+		}
+		files = conn.hidePendingUploads(path, files)
+
+		formatter := newListFormatter(files)
+		return conn.sendOutOfBandData(transfer, formatter.Short())
+	})
+	return nil
 }
 
 // commandMdtm responds to the MDTM FTP command. It allows the client to
 // retreive the last modified time of a file.
+//
+// Some clients send the time to set as the first parameter instead of using
+// MFMT, which is supported as well.
 type commandMdtm struct{}
 
 func (cmd commandMdtm) RequireParam() bool {
@@ -327,10 +635,27 @@ func (cmd commandMdtm) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandMdtm) Syntax() string {
+	return "[YYYYMMDDHHMMSS] <path>"
+}
+
 func (cmd commandMdtm) Execute(conn *ftpConn, param string) error {
+	if _, _, ok := parseFileTime(param); ok {
+		driver, ok := conn.driver.(FTPModifiedTimeDriver)
+		if !ok {
+			return fileTimeNotSupported(conn)
+		}
+		return setFileTime(conn, "MDTM", param, "Modify", driver.SetModifiedTime)
+	}
+
 	path := conn.buildPath(param)
+	if conn.isPendingUpload(path) {
+		_, err := conn.writeMessage(450, "File not available")
+		return err
+	}
+
 	var errs error
-	time, err := conn.driver.ModifiedTime(path)
+	time, err := conn.driver.ModifiedTime(conn.driverPath(path))
 	if err != nil {
 		errs = multierror.Append(errs, err)
 		if _, err := conn.writeMessage(450, "File not available"); err != nil {
@@ -342,6 +667,114 @@ func (cmd commandMdtm) Execute(conn *ftpConn, param string) error {
 	return err
 }
 
+// commandMfct responds to the MFCT FTP command, as described in
+// draft-somers-ftp-mfxx. It allows the client to set the creation time of a
+// file, if the driver implements FTPCreationTimeDriver.
+type commandMfct struct{}
+
+func (cmd commandMfct) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfct) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfct) Syntax() string {
+	return "YYYYMMDDHHMMSS <path>"
+}
+
+func (cmd commandMfct) Execute(conn *ftpConn, param string) error {
+	driver, ok := conn.driver.(FTPCreationTimeDriver)
+	if !ok {
+		return fileTimeNotSupported(conn)
+	}
+	return setFileTime(conn, "MFCT", param, "Create", driver.SetCreationTime)
+}
+
+// commandMfmt responds to the MFMT FTP command, as described in
+// draft-somers-ftp-mfxx. It allows the client to set the modification time
+// of a file, if the driver implements FTPModifiedTimeDriver.
+type commandMfmt struct{}
+
+func (cmd commandMfmt) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfmt) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfmt) Syntax() string {
+	return "YYYYMMDDHHMMSS <path>"
+}
+
+func (cmd commandMfmt) Execute(conn *ftpConn, param string) error {
+	driver, ok := conn.driver.(FTPModifiedTimeDriver)
+	if !ok {
+		return fileTimeNotSupported(conn)
+	}
+	return setFileTime(conn, "MFMT", param, "Modify", driver.SetModifiedTime)
+}
+
+// setFileTime handles a command that sets the time of a file, which is
+// changed with set. fact names the time in the reply, like "Modify".
+// Changing the time of a file requires the PermOverwrite permission.
+func setFileTime(conn *ftpConn, verb string, param string, fact string, set func(string, time.Time) error) error {
+	fileTime, filePath, ok := parseFileTime(param)
+	if !ok {
+		_, err := conn.writeMessage(501, "Syntax: "+verb+" YYYYMMDDHHMMSS <path>")
+		return err
+	}
+
+	path := conn.buildPath(filePath)
+	if !conn.permitted(PermOverwrite, path) {
+		return conn.permissionDenied()
+	}
+
+	if err := set(conn.driverPath(path), fileTime); err != nil {
+		var errs error
+		errs = multierror.Append(errs, fmt.Errorf("failed to execute %s path: %s - %w", verb, path, err))
+		if _, err := conn.writeMessage(550, "Could not set file time"); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		return errs
+	}
+
+	_, err := conn.writeMessage(213, fact+"="+fileTime.Format(fileTimeLayout)+"; "+filePath)
+	return err
+}
+
+// fileTimeNotSupported tells the client that the driver can't set file times
+func fileTimeNotSupported(conn *ftpConn) error {
+	_, err := conn.writeMessage(502, "Setting file times is not supported")
+	return err
+}
+
+// fileTimeLayout is the YYYYMMDDHHMMSS time format of RFC 3659
+const fileTimeLayout = "20060102150405"
+
+// parseFileTime splits a parameter like "20200102150405 file.txt" into the
+// time, which is always UTC and may have fractional seconds, and the path.
+// ok is false if param doesn't start with a time followed by a path.
+func parseFileTime(param string) (fileTime time.Time, filePath string, ok bool) {
+	parts := strings.SplitN(param, " ", 2)
+	if len(parts) != 2 || len(parts[0]) < len(fileTimeLayout) || strings.TrimSpace(parts[1]) == "" {
+		return time.Time{}, "", false
+	}
+	for _, c := range parts[0][:len(fileTimeLayout)] {
+		if c < '0' || c > '9' {
+			return time.Time{}, "", false
+		}
+	}
+
+	fileTime, err := time.ParseInLocation(fileTimeLayout, parts[0], time.UTC)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return fileTime, strings.TrimSpace(parts[1]), true
+}
+
 // commandMkd responds to the MKD FTP command. It allows the client to create
 // a new directory
 type commandMkd struct{}
@@ -354,14 +787,26 @@ func (cmd commandMkd) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandMkd) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandMkd) Execute(conn *ftpConn, param string) error {
 	path := conn.buildPath(param)
-	makeDir, err := conn.driver.MakeDir(path)
+	if !conn.permitted(PermMkdir, path) {
+		return conn.permissionDenied()
+	}
+	if err := conn.server.filenamePolicy.Check(path); err != nil {
+		return conn.filenameNotAllowed(err)
+	}
+
+	makeDir, err := conn.driver.MakeDir(conn.driverPath(path))
 	if err != nil {
 		return fmt.Errorf("failed to execute MKD: %s - %w", path, err)
 	}
 
 	if makeDir {
+		conn.notify(FTPEvent{Type: EventDirCreated, Path: path})
 		_, err := conn.writeMessage(257, "Directory created")
 		return err
 	}
@@ -386,6 +831,10 @@ func (cmd commandMode) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandMode) Syntax() string {
+	return "<mode>"
+}
+
 func (cmd commandMode) Execute(conn *ftpConn, param string) error {
 	if strings.ToUpper(param) == "S" {
 		_, err := conn.writeMessage(200, "OK")
@@ -410,6 +859,10 @@ func (cmd commandNoop) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandNoop) Syntax() string {
+	return ""
+}
+
 func (cmd commandNoop) Execute(conn *ftpConn, _ string) error {
 	_, err := conn.writeMessage(200, "OK")
 	return err
@@ -429,18 +882,38 @@ func (cmd commandOpts) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandOpts) Syntax() string {
+	return "<option> [<value>]"
+}
+
 func (cmd commandOpts) Execute(conn *ftpConn, param string) error {
 	if param == "UTF8 ON" || param == "UTF8" {
 		_, err := conn.writeMessage(200, "OK")
 		return err
 	}
 
+	// OPTS HASH reports or selects the algorithm of HASH
+	options := strings.SplitN(param, " ", 2)
+	if strings.ToUpper(options[0]) == "HASH" {
+		if len(options) == 2 {
+			algorithm := strings.ToUpper(strings.TrimSpace(options[1]))
+			if hashAlgorithms[algorithm] == nil {
+				_, err := conn.writeMessage(501, "Unknown algorithm, current selection not changed")
+				return err
+			}
+			conn.hashAlgorithm = algorithm
+		}
+		_, err := conn.writeMessage(200, conn.hashAlgorithm)
+		return err
+	}
+
 	_, err := conn.writeMessage(500, "Command not found")
 	return err
 }
 
 // commandPass respond to the PASS FTP command by asking the driver if the
-// supplied username and password are valid
+// supplied username and password are valid. Clients may retry a number of
+// times before they are disconnected.
 type commandPass struct{}
 
 func (cmd commandPass) RequireParam() bool {
@@ -451,14 +924,58 @@ func (cmd commandPass) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandPass) Syntax() string {
+	return "<password>"
+}
+
 func (cmd commandPass) Execute(conn *ftpConn, param string) error {
-	var errs error
+	if conn.user != "" {
+		_, err := conn.writeMessage(503, "Already logged in, use REIN to change the user.")
+		return err
+	}
+
+	tracker := conn.server.loginTracker
+	if tracker != nil && tracker.userBanned(conn.reqUser) {
+		conn.notify(FTPEvent{Type: EventLoginFailed, User: conn.reqUser, Err: ErrUserBanned})
+		return cmd.failed(conn, "Too many failed logins, try again later.", nil)
+	}
+
 	ok, err := conn.driver.Authenticate(conn.reqUser, param, conn.remoteIP())
 	if err != nil || !ok {
-		if _, err := conn.writeMessage(530, "Incorrect password, not logged in"); err != nil {
-			errs = multierror.Append(errs, err)
+		delay := conn.server.loginFailureDelay
+		if tracker != nil {
+			if trackerDelay := tracker.failed(conn.remoteIP(), conn.reqUser); trackerDelay > delay {
+				delay = trackerDelay
+			}
 		}
-		if _, err := conn.writeMessage(221, "Goodbye."); err != nil {
+		time.Sleep(delay)
+		conn.notify(FTPEvent{Type: EventLoginFailed, User: conn.reqUser, Err: err})
+		return cmd.failed(conn, "Incorrect password, not logged in", err)
+	}
+
+	if tracker != nil {
+		tracker.succeeded(conn.reqUser)
+	}
+
+	userOpts, err := conn.loadUserOpts(conn.reqUser)
+	if err != nil {
+		conn.notify(FTPEvent{Type: EventLoginFailed, User: conn.reqUser, Err: err})
+		return cmd.rejected(conn, "Unable to load user settings, not logged in", err)
+	}
+	remoteAddr := conn.conn.RemoteAddr().(*net.TCPAddr)
+	if !ipAllowed(userOpts.IPFilter, remoteAddr.IP) {
+		conn.notify(FTPEvent{Type: EventLoginFailed, User: conn.reqUser, Err: ErrLoginNotAllowed})
+		return cmd.rejected(conn, "Login not allowed from your address", nil)
+	}
+
+	maxSessions := conn.server.maxSessionsPerUser
+	if userOpts.MaxSessions != 0 {
+		maxSessions = userOpts.MaxSessions
+	}
+	if !conn.server.connections.acquireUser(conn.reqUser, maxSessions) {
+		conn.notify(FTPEvent{Type: EventLoginFailed, User: conn.reqUser, Err: ErrTooManySessions})
+		var errs error
+		if _, err := conn.writeMessage(421, "Too many connections for this user"); err != nil {
 			errs = multierror.Append(errs, err)
 		}
 		if err := conn.Close(); err != nil {
@@ -467,12 +984,62 @@ func (cmd commandPass) Execute(conn *ftpConn, param string) error {
 		return errs
 	}
 
+	conn.userOpts = userOpts
+	conn.userLimits = conn.server.userRateLimits.acquire(conn.reqUser, userOpts.UploadRateLimit, userOpts.DownloadRateLimit)
 	conn.user = conn.reqUser
 	conn.reqUser = ""
+	conn.loginAttempts = 0
+	conn.notify(FTPEvent{Type: EventLoginSucceeded})
 	_, err = conn.writeMessage(230, "Password ok, continue")
 	return err
 }
 
+// failed rejects a login attempt and disconnects the client once it used up
+// all of its attempts or got banned.
+func (cmd commandPass) failed(conn *ftpConn, message string, err error) error {
+	var errs error
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	conn.loginAttempts++
+	if _, err := conn.writeMessage(530, message); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	tracker := conn.server.loginTracker
+	banned := tracker != nil && tracker.ipBanned(conn.remoteIP())
+	if conn.loginAttempts < conn.server.maxLoginAttempts && !banned {
+		return errs
+	}
+
+	return multierror.Append(errs, cmd.disconnect(conn)).ErrorOrNil()
+}
+
+// rejected refuses the login of a user that supplied valid credentials but
+// isn't allowed in, and disconnects the client.
+func (cmd commandPass) rejected(conn *ftpConn, message string, err error) error {
+	var errs error
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if _, err := conn.writeMessage(530, message); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return multierror.Append(errs, cmd.disconnect(conn)).ErrorOrNil()
+}
+
+func (cmd commandPass) disconnect(conn *ftpConn) error {
+	var errs error
+	if _, err := conn.writeMessage(221, "Goodbye."); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if err := conn.Close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return errs
+}
+
 // commandPasv responds to the PASV FTP command.
 //
 // The client is requesting us to open a new TCP listing socket and wait for them
@@ -487,6 +1054,10 @@ func (cmd commandPasv) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandPasv) Syntax() string {
+	return ""
+}
+
 func (cmd commandPasv) Execute(conn *ftpConn, _ string) error {
 	var errs error
 	socket, err := conn.newPassiveSocket()
@@ -528,6 +1099,10 @@ func (cmd commandPort) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandPort) Syntax() string {
+	return "<h1,h2,h3,h4,p1,p2>"
+}
+
 func (cmd commandPort) Execute(conn *ftpConn, param string) error {
 	nums := strings.Split(param, ",")
 	if len(nums) < 6 {
@@ -575,13 +1150,17 @@ func (cmd commandPwd) RequireAuth() bool {
 	return true
 }
 
-func (cmd commandPwd) Execute(conn *ftpConn, _ string) error {
+func (cmd commandPwd) Syntax() string {
+	return ""
+}
+
+func (cmd commandPwd) Execute(conn *ftpConn, _ string) error {
 	_, err := conn.writeMessage(257, "\""+conn.namePrefix+"\" is the current directory")
 	return err
 }
 
 // CommandQuit responds to the QUIT FTP command. The client has requested the
-// connection be closed.
+// connection be closed. A running transfer is completed and answered first.
 type commandQuit struct{}
 
 func (cmd commandQuit) RequireParam() bool {
@@ -592,10 +1171,98 @@ func (cmd commandQuit) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandQuit) Syntax() string {
+	return ""
+}
+
 func (cmd commandQuit) Execute(conn *ftpConn, _ string) error {
+	if _, err := conn.writeMessage(221, "Goodbye."); err != nil {
+		return err
+	}
 	return conn.Close()
 }
 
+// commandRang responds to the RANG FTP command, as described in
+// draft-bryan-ftpext-hash. It limits the next HASH to the bytes from start up
+// to, but not including, end. "RANG 1 0" resets the range.
+type commandRang struct{}
+
+func (cmd commandRang) RequireParam() bool {
+	return true
+}
+
+func (cmd commandRang) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandRang) Syntax() string {
+	return "<start> <end>"
+}
+
+func (cmd commandRang) Execute(conn *ftpConn, param string) error {
+	parts := strings.Fields(param)
+	if len(parts) != 2 {
+		_, err := conn.writeMessage(501, "Syntax: RANG <start> <end>")
+		return err
+	}
+	start, startErr := strconv.ParseInt(parts[0], 10, 64)
+	end, endErr := strconv.ParseInt(parts[1], 10, 64)
+	if startErr != nil || endErr != nil {
+		_, err := conn.writeMessage(501, "Syntax: RANG <start> <end>")
+		return err
+	}
+
+	if start == 1 && end == 0 {
+		conn.hashRange = nil
+		_, err := conn.writeMessage(350, "Restart range reset")
+		return err
+	}
+	if start < 0 || end <= start {
+		_, err := conn.writeMessage(501, "Invalid range")
+		return err
+	}
+
+	conn.hashRange = &ftpHashRange{start: start, end: end}
+	_, err := conn.writeMessage(350, fmt.Sprintf("Restarting at %d. Ending at %d.", start, end))
+	return err
+}
+
+// commandRein responds to the REIN FTP command. It logs the user out and
+// resets the session, so the client can log in again without reconnecting.
+// A running transfer is completed first.
+type commandRein struct{}
+
+func (cmd commandRein) RequireParam() bool {
+	return false
+}
+
+func (cmd commandRein) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandRein) Syntax() string {
+	return ""
+}
+
+func (cmd commandRein) Execute(conn *ftpConn, _ string) error {
+	driver, err := conn.server.driverFactory.NewDriver()
+	if err != nil {
+		var errs error
+		errs = multierror.Append(errs, fmt.Errorf("failed to execute REIN - %w", err))
+		if _, err := conn.writeMessage(421, "Service not available, closing control connection."); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		if err := conn.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		return errs
+	}
+
+	conn.reinitialize(driver)
+	_, err = conn.writeMessage(220, "Service ready for new user.")
+	return err
+}
+
 // commandRetr responds to the RETR FTP command. It allows the client to
 // download a file.
 type commandRetr struct{}
@@ -608,10 +1275,21 @@ func (cmd commandRetr) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRetr) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandRetr) Execute(conn *ftpConn, param string) error {
 	path := conn.buildPath(param)
+	if !conn.permitted(PermDownload, path) {
+		return conn.permissionDenied()
+	}
+	if conn.dataConn == nil {
+		return conn.dataConnMissing()
+	}
+
 	var errs error
-	reader, err := conn.driver.GetFile(path)
+	reader, err := conn.driver.GetFile(conn.driverPath(path))
 	if err != nil {
 		errs = multierror.Append(errs, err)
 		if _, err := conn.writeMessage(551, "File not available"); err != nil {
@@ -620,11 +1298,24 @@ func (cmd commandRetr) Execute(conn *ftpConn, param string) error {
 		return errs
 	}
 
-	defer reader.Close()
 	if _, err = conn.writeMessage(150, "Data connection open. Transfer starting."); err != nil {
+		reader.Close()
 		return err
 	}
-	return conn.sendOutOfBandReader(reader)
+	conn.startTransfer("RETR", path, func(transfer *ftpTransfer) error {
+		defer reader.Close()
+		err := conn.sendOutOfBandReader(transfer, reader)
+
+		event := FTPEvent{Type: EventDownloadCompleted, Path: path, Bytes: transfer.progress(), Duration: time.Since(transfer.started)}
+		if transfer.isAborted() {
+			event.Type, event.Err = EventDownloadFailed, ErrTransferAborted
+		} else if err != nil {
+			event.Type, event.Err = EventDownloadFailed, err
+		}
+		conn.notify(event)
+		return err
+	})
+	return nil
 }
 
 // commandRnfr responds to the RNFR FTP command. It's the first of two commands
@@ -639,8 +1330,17 @@ func (cmd commandRnfr) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRnfr) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandRnfr) Execute(conn *ftpConn, param string) error {
-	conn.renameFrom = conn.buildPath(param)
+	path := conn.buildPath(param)
+	if !conn.permitted(PermRename, path) {
+		return conn.permissionDenied()
+	}
+
+	conn.renameFrom = path
 	_, err := conn.writeMessage(350, "Requested file action pending further information.")
 	return err
 }
@@ -657,6 +1357,10 @@ func (cmd commandRnto) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRnto) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandRnto) Execute(conn *ftpConn, param string) error {
 	if conn.renameFrom == "" {
 		_, err := conn.writeMessage(503, "Bad sequence of commands: use RNFR first.")
@@ -664,12 +1368,39 @@ func (cmd commandRnto) Execute(conn *ftpConn, param string) error {
 	}
 
 	toPath := conn.buildPath(param)
-	rename, err := conn.driver.Rename(conn.renameFrom, toPath)
+	if !conn.permitted(PermRename, toPath) {
+		return conn.permissionDenied()
+	}
+	if err := conn.server.filenamePolicy.Check(toPath); err != nil {
+		return conn.filenameNotAllowed(err)
+	}
+
+	// replacing a file needs the same permission as overwriting it with an
+	// upload, and the replaced file no longer counts towards the quota. A
+	// file renamed to itself replaces nothing.
+	replacedBytes := int64(-1)
+	overwrite := conn.permitted(PermOverwrite, toPath)
+	samePath := path.Clean(conn.driverPath(conn.renameFrom)) == path.Clean(conn.driverPath(toPath))
+	if !samePath && (conn.server.quotaProvider != nil || !overwrite) {
+		var err error
+		if replacedBytes, err = conn.driver.Bytes(conn.driverPath(toPath)); err != nil {
+			return fmt.Errorf("failed to execute RNTO from: %s to: %s - %w", conn.renameFrom, toPath, err)
+		}
+	}
+	if replacedBytes >= 0 && !overwrite {
+		return conn.permissionDenied()
+	}
+
+	rename, err := conn.driver.Rename(conn.driverPath(conn.renameFrom), conn.driverPath(toPath))
 	if err != nil {
 		return fmt.Errorf("failed to execute RNTO from: %s to: %s - %w", conn.renameFrom, toPath, err)
 	}
 
 	if rename {
+		if replacedBytes >= 0 {
+			conn.addUsage(-replacedBytes, -1)
+		}
+		conn.notify(FTPEvent{Type: EventRenamed, Path: toPath, FromPath: conn.renameFrom})
 		_, err := conn.writeMessage(250, "File renamed")
 		return err
 	}
@@ -690,14 +1421,23 @@ func (cmd commandRmd) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandRmd) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandRmd) Execute(conn *ftpConn, param string) error {
 	path := conn.buildPath(param)
-	deleteDir, err := conn.driver.DeleteDir(path)
+	if !conn.permitted(PermRmdir, path) {
+		return conn.permissionDenied()
+	}
+
+	deleteDir, err := conn.driver.DeleteDir(conn.driverPath(path))
 	if err != nil {
 		return fmt.Errorf("failed to execute RMD path: %s - %w", path, err)
 	}
 
 	if deleteDir {
+		conn.notify(FTPEvent{Type: EventDirRemoved, Path: path})
 		_, err := conn.writeMessage(250, "Directory deleted")
 		return err
 	}
@@ -706,6 +1446,81 @@ func (cmd commandRmd) Execute(conn *ftpConn, param string) error {
 	return err
 }
 
+// commandSite responds to the SITE FTP command. It runs subcommands for
+// operations that FTP has no command for, like SITE CHMOD. Applications add
+// subcommands with FTPServerOpts.SiteCommands, drivers by implementing
+// FTPSiteCommandDriver. SITE HELP lists them.
+type commandSite struct{}
+
+func (cmd commandSite) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSite) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandSite) Syntax() string {
+	return "<command> [<parameters>]"
+}
+
+func (cmd commandSite) Execute(conn *ftpConn, param string) error {
+	parts := strings.SplitN(param, " ", 2)
+	name := strings.ToUpper(parts[0])
+	subParam := ""
+	if len(parts) == 2 {
+		subParam = strings.TrimSpace(parts[1])
+	}
+
+	if name == "HELP" {
+		return cmd.help(conn, strings.ToUpper(subParam))
+	}
+
+	command := conn.siteCommand(name)
+	if command == nil {
+		_, err := conn.writeMessage(500, "Unknown SITE command "+name)
+		return err
+	}
+	if command.RequireAuth() && conn.user == "" {
+		_, err := conn.writeMessage(530, "not logged in")
+		return err
+	}
+	if command.RequireParam() && subParam == "" {
+		_, err := conn.writeMessage(501, "Syntax: SITE "+name+" "+command.Syntax())
+		return err
+	}
+	return command.Execute(conn, subParam)
+}
+
+// help lists the SITE subcommands, or describes the syntax of one of them
+func (cmd commandSite) help(conn *ftpConn, name string) error {
+	if name != "" {
+		if name == "HELP" {
+			_, err := conn.writeMessage(214, "Syntax: SITE HELP [<command>]")
+			return err
+		}
+		command := conn.siteCommand(name)
+		if command == nil {
+			_, err := conn.writeMessage(502, "Unknown SITE command "+name)
+			return err
+		}
+		syntax := "SITE " + name
+		if command.Syntax() != "" {
+			syntax += " " + command.Syntax()
+		}
+		_, err := conn.writeMessage(214, "Syntax: "+syntax)
+		return err
+	}
+
+	lines := []string{"214-The following SITE commands are recognized:"}
+	for _, name := range conn.siteCommandNames() {
+		lines = append(lines, " "+name)
+	}
+	lines = append(lines, "214 Help OK.")
+	_, err := conn.writeLines(214, lines...)
+	return err
+}
+
 // commandSize responds to the SIZE FTP command. It returns the size of the
 // requested path in bytes.
 type commandSize struct{}
@@ -718,9 +1533,18 @@ func (cmd commandSize) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandSize) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandSize) Execute(conn *ftpConn, param string) error {
 	path := conn.buildPath(param)
-	bytes, err := conn.driver.Bytes(path)
+	if conn.isPendingUpload(path) {
+		_, err := conn.writeMessage(450, "file not available")
+		return err
+	}
+
+	bytes, err := conn.driver.Bytes(conn.driverPath(path))
 	if err != nil {
 		return fmt.Errorf("failed to execute SIZE path: %s - %w", path, err)
 	}
@@ -734,6 +1558,103 @@ func (cmd commandSize) Execute(conn *ftpConn, param string) error {
 	return err
 }
 
+// commandStat responds to the STAT FTP command, as described in RFC 959.
+//
+// Without a parameter it reports the status of the session, including the
+// progress of a running transfer. With a path it lists the directory on the
+// control connection, like LIST does on a data connection.
+type commandStat struct{}
+
+func (cmd commandStat) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStat) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandStat) Syntax() string {
+	return "[<path>]"
+}
+
+func (cmd commandStat) Execute(conn *ftpConn, param string) error {
+	// during a transfer STAT always reports on the transfer
+	if param == "" || conn.activeTransfer() != nil {
+		return cmd.status(conn)
+	}
+
+	if conn.user == "" {
+		_, err := conn.writeMessage(530, "not logged in")
+		return err
+	}
+
+	path := conn.buildPath(param)
+	if !conn.permitted(PermList, path) {
+		return conn.permissionDenied()
+	}
+
+	files, err := conn.driver.DirContents(conn.driverPath(path))
+	if err != nil {
+		var errs error
+		errs = multierror.Append(errs, fmt.Errorf("failed to execute STAT path: %s - %w", path, err))
+		if _, err := conn.writeMessage(550, "Directory not available"); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		return errs
+	}
+	files = conn.hidePendingUploads(path, files)
+
+	lines := []string{"213-Status of " + path + ":"}
+	for _, line := range strings.Split(newListFormatter(files).Detailed(), "\r\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, "213 End of status")
+	_, err = conn.writeLines(213, lines...)
+	return err
+}
+
+// status reports the state of the session
+func (cmd commandStat) status(conn *ftpConn) error {
+	lines := []string{
+		"211-FTP server status:",
+		" Connected to " + conn.remoteIP(),
+	}
+	if conn.user != "" {
+		lines = append(lines, " Logged in as "+conn.user)
+	} else {
+		lines = append(lines, " Not logged in")
+	}
+	lines = append(lines,
+		" Current directory: "+conn.namePrefix,
+		" TYPE: "+conn.dataType+"; STRUcture: File; transfer MODE: Stream",
+	)
+
+	transfer := conn.activeTransfer()
+	dataConn := conn.dataConn
+	if transfer != nil {
+		dataConn = transfer.dataConn
+	}
+	switch socket := dataConn.(type) {
+	case *ftpPassiveSocket:
+		lines = append(lines, fmt.Sprintf(" Passive data connection on port %d", socket.Port()))
+	case *ftpActiveSocket:
+		lines = append(lines, fmt.Sprintf(" Active data connection to %s", buildTcpString(socket.Host(), socket.Port())))
+	default:
+		lines = append(lines, " No data connection")
+	}
+
+	if transfer != nil {
+		elapsed := time.Since(transfer.started).Truncate(time.Second)
+		lines = append(lines, fmt.Sprintf(" %s %s: %d bytes transferred in %s", transfer.command, transfer.path, transfer.progress(), elapsed))
+	}
+
+	lines = append(lines, "211 End of status")
+	_, err := conn.writeLines(211, lines...)
+	return err
+}
+
 // commandStor responds to the STOR FTP command. It allows the user to upload a
 // new file.
 type commandStor struct{}
@@ -746,24 +1667,282 @@ func (cmd commandStor) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandStor) Syntax() string {
+	return "<path>"
+}
+
 func (cmd commandStor) Execute(conn *ftpConn, param string) error {
 	targetPath := conn.buildPath(param)
-	if _, err := conn.writeMessage(150, "Data transfer starting"); err != nil {
+	if !conn.permitted(PermUpload, targetPath) {
+		return conn.permissionDenied()
+	}
+	if err := conn.server.filenamePolicy.Check(targetPath); err != nil {
+		return conn.filenameNotAllowed(err)
+	}
+	return cmd.store(conn, "STOR", targetPath, "Data transfer starting", "Transfer complete.")
+}
+
+// store uploads a file to targetPath, after the caller checked that the user
+// may create it. The 150 and 226 replies use the given messages.
+func (cmd commandStor) store(conn *ftpConn, verb string, targetPath string, startMessage string, completeMessage string) error {
+	if conn.dataConn == nil {
+		return conn.dataConnMissing()
+	}
+
+	var quota *FTPQuota
+	if provider := conn.server.quotaProvider; provider != nil {
+		var err error
+		if quota, err = provider.Quota(conn.user); err != nil {
+			return fmt.Errorf("failed to execute %s path: %s - %w", verb, targetPath, err)
+		}
+	}
+
+	existingBytes := int64(-1)
+	overwrite := conn.permitted(PermOverwrite, targetPath)
+	if quota != nil || !overwrite {
+		var err error
+		if existingBytes, err = conn.driver.Bytes(conn.driverPath(targetPath)); err != nil {
+			return fmt.Errorf("failed to execute %s path: %s - %w", verb, targetPath, err)
+		}
+	}
+	if existingBytes >= 0 && !overwrite {
+		return conn.permissionDenied()
+	}
+
+	// an upload may use the space that's left plus the space of the file it
+	// replaces
+	uploadLimit := int64(-1)
+	if quota != nil {
+		if quota.MaxFiles > 0 && existingBytes < 0 && quota.UsedFiles >= quota.MaxFiles {
+			_, err := conn.writeMessage(552, "Exceeded storage allocation")
+			return err
+		}
+		if available := quota.AvailableBytes(); available >= 0 {
+			if existingBytes > 0 {
+				available += existingBytes
+			}
+			uploadLimit = available
+		}
+	}
+
+	if _, err := conn.writeMessage(150, startMessage); err != nil {
 		return err
 	}
 
-	putFile, err := conn.driver.PutFile(targetPath, conn.dataConn)
-	if err != nil {
-		return fmt.Errorf("failed to execute STOR path: %s - %w", targetPath, err)
+	conn.startTransfer(verb, targetPath, func(transfer *ftpTransfer) error {
+		conn.notify(FTPEvent{Type: EventUploadStarted, Path: targetPath})
+		stored := false
+		var failure error
+		defer func() {
+			event := FTPEvent{Type: EventUploadCompleted, Path: targetPath, Bytes: transfer.progress(), Duration: time.Since(transfer.started)}
+			if !stored {
+				event.Type, event.Err = EventUploadFailed, failure
+			}
+			conn.notify(event)
+		}()
+
+		// atomic uploads are written to a temporary file first, which only
+		// replaces the target once the transfer completed
+		uploadPath := targetPath
+		if conn.server.atomicUploads {
+			uploadPath = atomicUploadPath(conn.server.atomicUploadPattern, targetPath, conn.sessionId)
+			conn.server.pendingUploads.add(conn.driverPath(uploadPath))
+			defer conn.server.pendingUploads.remove(conn.driverPath(uploadPath))
+		}
+
+		quotaReader := newUploadLimitReader(transfer.countingReader(conn.uploadReader(transfer.dataConn)), uploadLimit, ErrQuotaExceeded)
+		sizeReader := newUploadLimitReader(quotaReader, conn.maxUploadSize(), ErrUploadTooLarge)
+		putFile, err := conn.driver.PutFile(conn.driverPath(uploadPath), sizeReader)
+		if transfer.isAborted() {
+			failure = ErrTransferAborted
+			return cmd.abort(conn, transfer, uploadPath, targetPath, ErrTransferAborted, err)
+		}
+		if quotaReader.exceeded() {
+			failure = ErrQuotaExceeded
+			return cmd.abort(conn, transfer, uploadPath, targetPath, ErrQuotaExceeded, err)
+		}
+		if sizeReader.exceeded() {
+			failure = ErrUploadTooLarge
+			return cmd.abort(conn, transfer, uploadPath, targetPath, ErrUploadTooLarge, err)
+		}
+		if err != nil {
+			failure = err
+			cmd.discard(conn, uploadPath, targetPath)
+			return fmt.Errorf("failed to execute %s path: %s - %w", verb, targetPath, err)
+		}
+
+		if putFile && uploadPath != targetPath {
+			renamed, err := conn.driver.Rename(conn.driverPath(uploadPath), conn.driverPath(targetPath))
+			if err != nil || !renamed {
+				failure = errUploadNotStored
+				if err != nil {
+					failure = err
+				}
+				cmd.discard(conn, uploadPath, targetPath)
+				var errs error
+				if err != nil {
+					errs = multierror.Append(errs, fmt.Errorf("failed to execute %s path: %s - %w", verb, targetPath, err))
+				}
+				if _, err := conn.writeTransferMessage(450, "error during transfer"); err != nil {
+					errs = multierror.Append(errs, err)
+				}
+				return errs
+			}
+		}
+
+		if putFile {
+			// a replaced file only changes the size of the stored data
+			if quota != nil {
+				bytes, files := quotaReader.read, int64(1)
+				if existingBytes >= 0 {
+					bytes, files = bytes-existingBytes, 0
+				}
+				conn.addUsage(bytes, files)
+			}
+			stored = true
+			_, err := conn.writeTransferMessage(226, completeMessage)
+			return err
+		}
+
+		failure = errUploadNotStored
+		cmd.discard(conn, uploadPath, targetPath)
+		_, err = conn.writeTransferMessage(450, "error during transfer")
+		return err
+	})
+	return nil
+}
+
+// errUploadNotStored is the error of upload events when the driver didn't
+// store an upload without saying why
+var errUploadNotStored = errors.New("upload was not stored")
+
+// discard deletes the temporary file of a failed atomic upload. It does
+// nothing for other uploads.
+func (cmd commandStor) discard(conn *ftpConn, uploadPath string, targetPath string) {
+	if uploadPath == targetPath {
+		return
+	}
+	if _, err := conn.driver.DeleteFile(conn.driverPath(uploadPath)); err != nil && conn.logger != nil {
+		conn.logger.Warnf("failed to delete temporary upload %s %v", uploadPath, err)
 	}
+}
+
+// abort ends an upload that was cut short, because it broke a limit or the
+// client aborted it, and tells the driver so it can discard the partial file.
+func (cmd commandStor) abort(conn *ftpConn, transfer *ftpTransfer, uploadPath string, targetPath string, reason error, err error) error {
+	var errs error
+	aborted := reason == ErrTransferAborted
+	// reading from the closed data connection of an aborted transfer fails
+	// as expected
+	if err != nil && !aborted && !errors.Is(err, reason) {
+		errs = multierror.Append(errs, err)
+	}
+
+	// stop the client from sending any more data
+	if !aborted {
+		if err := transfer.dataConn.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	if driver, ok := conn.driver.(FTPUploadAbortDriver); ok {
+		if err := driver.AbortUpload(conn.driverPath(uploadPath), reason); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	cmd.discard(conn, uploadPath, targetPath)
+
+	code, message := 552, "Exceeded storage allocation"
+	switch reason {
+	case ErrUploadTooLarge:
+		message = "Exceeded maximum upload size"
+	case ErrTransferAborted:
+		code, message = 426, "Connection closed; transfer aborted."
+	}
+	if _, err := conn.writeTransferMessage(code, message); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return errs
+}
+
+// commandStou responds to the STOU FTP command. It allows the client to
+// upload a file under a name the server picks, so uploads never replace
+// existing files. The name is reported in the 150 and 226 replies as
+// RFC 1123 requires.
+//
+// Clients may suggest a name, which is used if it doesn't exist yet and
+// otherwise gets a numbered suffix.
+type commandStou struct{}
 
-	if putFile {
-		_, err := conn.writeMessage(226, "Transfer complete.")
+// the number of numbered suffixes tried for a suggested name
+const maxUniqueNameAttempts = 100
+
+func (cmd commandStou) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStou) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandStou) Syntax() string {
+	return "[<name>]"
+}
+
+func (cmd commandStou) Execute(conn *ftpConn, param string) error {
+	targetPath, err := cmd.uniquePath(conn, param)
+	if err != nil {
+		return fmt.Errorf("failed to execute STOU - %w", err)
+	}
+	if targetPath == "" {
+		_, err := conn.writeMessage(450, "Unable to find a unique file name")
 		return err
 	}
 
-	_, err = conn.writeMessage(450, "error during transfer")
-	return err
+	if !conn.permitted(PermUpload, targetPath) {
+		return conn.permissionDenied()
+	}
+	if err := conn.server.filenamePolicy.Check(targetPath); err != nil {
+		return conn.filenameNotAllowed(err)
+	}
+
+	name := path.Base(targetPath)
+	return commandStor{}.store(conn, "STOU", targetPath, "FILE: "+name, "Transfer complete (unique file name: "+name+").")
+}
+
+// uniquePath returns a path in the current directory that doesn't exist yet,
+// or an empty string if it couldn't find one. The driver is asked whether
+// the file exists, another client may still create it before the upload
+// starts.
+func (cmd commandStou) uniquePath(conn *ftpConn, name string) (string, error) {
+	// only the name is used, uploads always go to the current directory
+	if name != "" {
+		name = strings.TrimPrefix(path.Base(conn.buildPath(name)), "/")
+	}
+
+	candidates := make([]string, 0, maxUniqueNameAttempts+1)
+	if name != "" {
+		candidates = append(candidates, name)
+		for i := 1; i <= maxUniqueNameAttempts; i++ {
+			candidates = append(candidates, name+"."+strconv.Itoa(i))
+		}
+	} else {
+		for i := 0; i < 3; i++ {
+			candidates = append(candidates, "ftp"+newSessionId())
+		}
+	}
+
+	for _, candidate := range candidates {
+		candidatePath := conn.buildPath(candidate)
+		bytes, err := conn.driver.Bytes(conn.driverPath(candidatePath))
+		if err != nil {
+			return "", err
+		}
+		if bytes < 0 {
+			return candidatePath, nil
+		}
+	}
+	return "", nil
 }
 
 // commandStru responds to the STRU FTP command.
@@ -785,6 +1964,10 @@ func (cmd commandStru) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandStru) Syntax() string {
+	return "<structure>"
+}
+
 func (cmd commandStru) Execute(conn *ftpConn, param string) error {
 	if strings.ToUpper(param) == "F" {
 		_, err := conn.writeMessage(200, "OK")
@@ -806,6 +1989,10 @@ func (cmd commandSyst) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandSyst) Syntax() string {
+	return ""
+}
+
 func (cmd commandSyst) Execute(conn *ftpConn, _ string) error {
 	_, err := conn.writeMessage(215, "UNIX Type: L8")
 	return err
@@ -831,13 +2018,19 @@ func (cmd commandType) RequireAuth() bool {
 	return true
 }
 
+func (cmd commandType) Syntax() string {
+	return "<type>"
+}
+
 func (cmd commandType) Execute(conn *ftpConn, param string) error {
 	if strings.ToUpper(param) == "A" {
+		conn.dataType = "ASCII"
 		_, err := conn.writeMessage(200, "Type set to ASCII")
 		return err
 	}
 
 	if strings.ToUpper(param) == "I" {
+		conn.dataType = "Binary"
 		_, err := conn.writeMessage(200, "Type set to binary")
 		return err
 	}
@@ -857,8 +2050,85 @@ func (cmd commandUser) RequireAuth() bool {
 	return false
 }
 
+func (cmd commandUser) Syntax() string {
+	return "<username>"
+}
+
 func (cmd commandUser) Execute(conn *ftpConn, param string) error {
+	if conn.user != "" {
+		_, err := conn.writeMessage(503, "Already logged in, use REIN to change the user.")
+		return err
+	}
 	conn.reqUser = param
 	_, err := conn.writeMessage(331, "User name ok, password required")
 	return err
 }
+
+// commandXHash responds to the XCRC, XMD5, XSHA1, XSHA256 and XSHA512 FTP
+// commands, which predate HASH but are still used by many clients. Each of
+// them returns the hash of a whole file with a fixed algorithm.
+type commandXHash struct {
+	algorithm string
+}
+
+func (cmd commandXHash) RequireParam() bool {
+	return true
+}
+
+func (cmd commandXHash) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandXHash) Syntax() string {
+	return "<path>"
+}
+
+func (cmd commandXHash) Execute(conn *ftpConn, param string) error {
+	sum, _, _, err := computeHash(conn, "X"+strings.Replace(cmd.algorithm, "-", "", -1), param, cmd.algorithm, nil)
+	if err != nil || sum == "" {
+		return err
+	}
+	_, err = conn.writeMessage(250, sum)
+	return err
+}
+
+// computeHash hashes the file at param, or the part of it in hashRange, and
+// returns the hash with the range it covers. When the file can't be hashed
+// it replies to the client itself and returns an empty hash.
+func computeHash(conn *ftpConn, verb string, param string, algorithm string, hashRange *ftpHashRange) (string, int64, int64, error) {
+	path := conn.buildPath(param)
+	if !conn.permitted(PermDownload, path) {
+		return "", 0, 0, conn.permissionDenied()
+	}
+
+	size, err := conn.driver.Bytes(conn.driverPath(path))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to execute %s path: %s - %w", verb, path, err)
+	}
+	if size < 0 {
+		_, err := conn.writeMessage(550, "File not available")
+		return "", 0, 0, err
+	}
+
+	start, end := int64(0), size
+	if hashRange != nil {
+		start = hashRange.start
+		if hashRange.end < end {
+			end = hashRange.end
+		}
+		if start > end {
+			start = end
+		}
+	}
+
+	sum, err := fileHash(conn.driver, conn.driverPath(path), algorithm, start, end, size)
+	if err != nil {
+		var errs error
+		errs = multierror.Append(errs, fmt.Errorf("failed to execute %s path: %s - %w", verb, path, err))
+		if _, err := conn.writeMessage(550, "Could not compute hash"); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		return "", 0, 0, errs
+	}
+	return sum, start, end, nil
+}
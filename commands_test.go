@@ -2,20 +2,27 @@ package graval
 
 import (
 	. "github.com/smartystreets/goconvey/convey"
+	"strings"
 	"testing"
 )
 
 func TestStringMapsToCorrectCommands(t *testing.T) {
 	Convey("Command map calls correct objects", t, func() {
+		So(commands["ABOR"], ShouldHaveSameTypeAs, commandAbor{})
 		So(commands["ALLO"], ShouldHaveSameTypeAs, commandAllo{})
+		So(commands["AVBL"], ShouldHaveSameTypeAs, commandAvbl{})
 		So(commands["CDUP"], ShouldHaveSameTypeAs, commandCdup{})
 		So(commands["CWD"], ShouldHaveSameTypeAs, commandCwd{})
 		So(commands["DELE"], ShouldHaveSameTypeAs, commandDele{})
 		So(commands["EPRT"], ShouldHaveSameTypeAs, commandEprt{})
 		So(commands["EPSV"], ShouldHaveSameTypeAs, commandEpsv{})
+		So(commands["HASH"], ShouldHaveSameTypeAs, commandHash{})
+		So(commands["HELP"], ShouldHaveSameTypeAs, commandHelp{})
 		So(commands["LIST"], ShouldHaveSameTypeAs, commandList{})
 		So(commands["NLST"], ShouldHaveSameTypeAs, commandNlst{})
 		So(commands["MDTM"], ShouldHaveSameTypeAs, commandMdtm{})
+		So(commands["MFCT"], ShouldHaveSameTypeAs, commandMfct{})
+		So(commands["MFMT"], ShouldHaveSameTypeAs, commandMfmt{})
 		So(commands["MKD"], ShouldHaveSameTypeAs, commandMkd{})
 		So(commands["MODE"], ShouldHaveSameTypeAs, commandMode{})
 		So(commands["NOOP"], ShouldHaveSameTypeAs, commandNoop{})
@@ -24,19 +31,37 @@ func TestStringMapsToCorrectCommands(t *testing.T) {
 		So(commands["PORT"], ShouldHaveSameTypeAs, commandPort{})
 		So(commands["PWD"], ShouldHaveSameTypeAs, commandPwd{})
 		So(commands["QUIT"], ShouldHaveSameTypeAs, commandQuit{})
+		So(commands["RANG"], ShouldHaveSameTypeAs, commandRang{})
+		So(commands["REIN"], ShouldHaveSameTypeAs, commandRein{})
 		So(commands["RETR"], ShouldHaveSameTypeAs, commandRetr{})
 		So(commands["RNFR"], ShouldHaveSameTypeAs, commandRnfr{})
 		So(commands["RNTO"], ShouldHaveSameTypeAs, commandRnto{})
 		So(commands["RMD"], ShouldHaveSameTypeAs, commandRmd{})
+		So(commands["SITE"], ShouldHaveSameTypeAs, commandSite{})
 		So(commands["SIZE"], ShouldHaveSameTypeAs, commandSize{})
+		So(commands["STAT"], ShouldHaveSameTypeAs, commandStat{})
 		So(commands["STOR"], ShouldHaveSameTypeAs, commandStor{})
+		So(commands["STOU"], ShouldHaveSameTypeAs, commandStou{})
 		So(commands["STRU"], ShouldHaveSameTypeAs, commandStru{})
 		So(commands["SYST"], ShouldHaveSameTypeAs, commandSyst{})
 		So(commands["TYPE"], ShouldHaveSameTypeAs, commandType{})
 		So(commands["USER"], ShouldHaveSameTypeAs, commandUser{})
+		So(commands["XCRC"], ShouldResemble, commandXHash{algorithm: "CRC32"})
 		So(commands["XCUP"], ShouldHaveSameTypeAs, commandCdup{})
 		So(commands["XCWD"], ShouldHaveSameTypeAs, commandCwd{})
 		So(commands["XPWD"], ShouldHaveSameTypeAs, commandPwd{})
 		So(commands["XRMD"], ShouldHaveSameTypeAs, commandRmd{})
+		So(commands["XSHA256"], ShouldResemble, commandXHash{algorithm: "SHA-256"})
+	})
+}
+
+func TestCommandSyntax(t *testing.T) {
+	Convey("Every command describes its syntax", t, func() {
+		for verb, command := range commands {
+			if command.RequireParam() {
+				So(command.Syntax(), ShouldNotBeBlank)
+			}
+			So(verb, ShouldEqual, strings.ToUpper(verb))
+		}
 	})
 }
@@ -0,0 +1,70 @@
+package graval
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// defaultAtomicUploadPattern is used for the names of temporary upload files
+// when the AtomicUploadPattern option is empty
+const defaultAtomicUploadPattern = ".{name}.{session}.part"
+
+// atomicUploadPath returns the temporary path an upload to targetPath is
+// written to before it's renamed. It is in the same directory as the target,
+// named after pattern with "{name}" replaced by the name of the target and
+// "{session}" by the id of the session.
+func atomicUploadPath(pattern string, targetPath string, sessionId string) string {
+	name := strings.Replace(pattern, "{name}", path.Base(targetPath), -1)
+	name = strings.Replace(name, "{session}", sessionId, -1)
+	return path.Join(path.Dir(targetPath), name)
+}
+
+// pendingUploads keeps track of the temporary files of the atomic uploads
+// that are in progress, by their path on the driver. Clients can't see or
+// access them, while files that merely have a similar name are left alone.
+type pendingUploads struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func newPendingUploads() *pendingUploads {
+	return &pendingUploads{paths: make(map[string]bool)}
+}
+
+func (uploads *pendingUploads) add(driverPath string) {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	uploads.paths[driverPath] = true
+}
+
+func (uploads *pendingUploads) remove(driverPath string) {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	delete(uploads.paths, driverPath)
+}
+
+func (uploads *pendingUploads) contains(driverPath string) bool {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	return uploads.paths[driverPath]
+}
+
+// isPendingUpload returns true if clientPath is the temporary file of an
+// atomic upload that is in progress
+func (ftpConn *ftpConn) isPendingUpload(clientPath string) bool {
+	return ftpConn.server.pendingUploads.contains(ftpConn.driverPath(clientPath))
+}
+
+// hidePendingUploads removes the temporary files of atomic uploads that are
+// in progress from a listing of the directory dirPath
+func (ftpConn *ftpConn) hidePendingUploads(dirPath string, files []os.FileInfo) []os.FileInfo {
+	visible := files[:0:0]
+	for _, file := range files {
+		if !ftpConn.isPendingUpload(path.Join(dirPath, file.Name())) {
+			visible = append(visible, file)
+		}
+	}
+	return visible
+}
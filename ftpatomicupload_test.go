@@ -0,0 +1,46 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAtomicUploadNames(t *testing.T) {
+	Convey("Temporary upload names", t, func() {
+		Convey("Will be in the directory of the target", func() {
+			So(atomicUploadPath(defaultAtomicUploadPattern, "/files/report.csv", "abc"), ShouldEqual, "/files/.report.csv.abc.part")
+			So(atomicUploadPath("{name}.tmp", "/report.csv", "abc"), ShouldEqual, "/report.csv.tmp")
+		})
+	})
+
+	Convey("Temporary files of uploads in progress", t, func() {
+		conn := &ftpConn{server: NewFTPServer(&FTPServerOpts{AtomicUploads: true})}
+		conn.server.pendingUploads.add("/files/.report.csv.abc.part")
+
+		Convey("Will be hidden from listings", func() {
+			files := []os.FileInfo{
+				NewFileItem("report.csv", 10, time.Unix(0, 0)),
+				NewFileItem(".report.csv.abc.part", 5, time.Unix(0, 0)),
+				NewFileItem(".notes.txt.mine.part", 5, time.Unix(0, 0)),
+			}
+			visible := conn.hidePendingUploads("/files", files)
+			So(len(visible), ShouldEqual, 2)
+			So(visible[0].Name(), ShouldEqual, "report.csv")
+			So(visible[1].Name(), ShouldEqual, ".notes.txt.mine.part")
+			So(len(files), ShouldEqual, 3)
+		})
+
+		Convey("Will not be accessible", func() {
+			So(conn.permitted(PermDownload, "/files/.report.csv.abc.part"), ShouldBeFalse)
+			So(conn.permitted(PermDownload, "/files/../files/.report.csv.abc.part"), ShouldBeFalse)
+			So(conn.permitted(PermDownload, "/files/.notes.txt.mine.part"), ShouldBeTrue)
+		})
+
+		Convey("Will be accessible once the upload ended", func() {
+			conn.server.pendingUploads.remove("/files/.report.csv.abc.part")
+			So(conn.permitted(PermDownload, "/files/.report.csv.abc.part"), ShouldBeTrue)
+		})
+	})
+}
@@ -3,12 +3,17 @@ package graval
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -20,34 +25,57 @@ type ftpConn struct {
 	controlWriter    *bufio.Writer
 	dataConn         ftpDataSocket
 	driver           FTPDriver
+	server           *FTPServer
 	logger           FTPLogger
 	serverName       string
 	sessionId        string
 	namePrefix       string
 	reqUser          string
 	user             string
+	userOpts         *FTPUserOpts
 	renameFrom       string
+	dataType         string
+	command          string
+	hashAlgorithm    string
+	hashRange        *ftpHashRange
+	loginAttempts    int
+	sessionLimits    *rateLimits
+	userLimits       *rateLimits
+	connectedAt      time.Time
+	loginStart       time.Time
 	minDataPort      uint16
 	maxDataPort      uint16
 	pasvAdvertisedIp string
+	transfer         *ftpTransfer
+	mu               sync.Mutex
+	writeMu          sync.Mutex
+	replyCode        int
 }
 
 // NewftpConn constructs a new object that will handle the FTP protocol over
 // an active net.TCPConn. The TCP connection should already be open before
 // it is handed to this functions. driver is an instance of FTPDriver that
-// will handle all auth and persistence details.
-func newFtpConn(tcpConn net.Conn, driver FTPDriver, ftpLogger FTPLogger, serverName string, minPort uint16, maxPort uint16, pasvAdvertisedIp string) *ftpConn {
+// will handle all auth and persistence details. server is the FTPServer that
+// accepted the connection and provides its configuration.
+func newFtpConn(tcpConn net.Conn, driver FTPDriver, server *FTPServer) *ftpConn {
 	c := new(ftpConn)
 	c.namePrefix = "/"
 	c.conn = tcpConn
 	c.controlReader = bufio.NewReader(tcpConn)
 	c.controlWriter = bufio.NewWriter(tcpConn)
 	c.driver = driver
-	c.logger = ftpLogger
-	c.serverName = serverName
-	c.minDataPort = minPort
-	c.maxDataPort = maxPort
-	c.pasvAdvertisedIp = pasvAdvertisedIp
+	c.server = server
+	c.logger = server.logger
+	c.serverName = server.serverName
+	c.minDataPort = server.pasvMinPort
+	c.maxDataPort = server.pasvMaxPort
+	c.pasvAdvertisedIp = server.pasvAdvertisedIp
+	c.connectedAt = time.Now()
+	c.loginStart = c.connectedAt
+	c.sessionId = newSessionId()
+	c.dataType = "ASCII"
+	c.hashAlgorithm = defaultHashAlgorithm
+	c.sessionLimits = newRateLimits(server.sessionUploadRateLimit, server.sessionDownloadRateLimit)
 	return c
 }
 
@@ -64,16 +92,31 @@ func (ftpConn *ftpConn) Serve() error {
 			}
 		}
 
+		// closing the connection stops a running transfer, which must not
+		// outlive the session
+		transfer := ftpConn.activeTransfer()
+		if transfer != nil {
+			transfer.abort()
+		}
 		if err := ftpConn.Close(); err != nil {
 			if ftpConn.logger != nil {
 				ftpConn.logger.Warnf("failed to close connection %v", err)
 			}
 		}
+		if transfer != nil {
+			transfer.wait()
+		}
+
+		if ftpConn.user != "" {
+			ftpConn.releaseUser()
+		}
+		ftpConn.notify(FTPEvent{Type: EventDisconnected, Duration: time.Since(ftpConn.connectedAt)})
 	}()
 
 	if ftpConn.logger != nil {
 		ftpConn.logger.Debugf("Connection Established (local: %s, remote: %s)", ftpConn.localIP(), ftpConn.remoteIP())
 	}
+	ftpConn.notify(FTPEvent{Type: EventConnected})
 
 	// send welcome
 	_, err := ftpConn.writeMessage(220, ftpConn.serverName)
@@ -81,11 +124,29 @@ func (ftpConn *ftpConn) Serve() error {
 		return err
 	}
 	// read commands
+	var pending string
 	for {
+		deadline, timeoutMessage := ftpConn.readDeadline()
+		if err := ftpConn.conn.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+
 		line, err := ftpConn.controlReader.ReadString('\n')
+		pending += line
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// clients are quiet while a long transfer is running
+				if ftpConn.activeTransfer() != nil {
+					continue
+				}
+				if ftpConn.logger != nil {
+					ftpConn.logger.Debugf("Timeout for client: %s", ftpConn.remoteIP())
+				}
+				ftpConn.writeMessage(421, timeoutMessage)
+			}
 			break
 		}
+		line, pending = pending, ""
 
 		if err := ftpConn.receiveLine(line); err != nil {
 			if ftpConn.logger != nil {
@@ -100,6 +161,33 @@ func (ftpConn *ftpConn) Serve() error {
 	return nil
 }
 
+// newSessionId returns a random id that identifies a client connection
+func newSessionId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// readDeadline returns when reading the next command times out, and the
+// message to send the client if it does. The zero time means no timeout.
+func (ftpConn *ftpConn) readDeadline() (time.Time, string) {
+	var deadline time.Time
+	message := "Timeout, closing control connection."
+	if ftpConn.server.idleTimeout > 0 {
+		deadline = time.Now().Add(ftpConn.server.idleTimeout)
+	}
+	if ftpConn.user == "" && ftpConn.server.loginTimeout > 0 {
+		loginDeadline := ftpConn.loginStart.Add(ftpConn.server.loginTimeout)
+		if deadline.IsZero() || loginDeadline.Before(deadline) {
+			deadline = loginDeadline
+			message = "Login timeout, closing control connection."
+		}
+	}
+	return deadline, message
+}
+
 // Close will manually close this connection, even if the client isn't ready.
 func (ftpConn *ftpConn) Close() error {
 	var errs error
@@ -116,6 +204,72 @@ func (ftpConn *ftpConn) Close() error {
 	return errs
 }
 
+// releaseUser forgets the session of the logged in user in the counters and
+// limiters the server keeps per user
+func (ftpConn *ftpConn) releaseUser() {
+	ftpConn.server.connections.releaseUser(ftpConn.user)
+	ftpConn.server.userRateLimits.release(ftpConn.user)
+}
+
+// siteCommand returns the SITE subcommand with the given name, or nil.
+// Subcommands of the driver win over the ones of the server.
+func (ftpConn *ftpConn) siteCommand(name string) FTPCommand {
+	if driver, ok := ftpConn.driver.(FTPSiteCommandDriver); ok {
+		for driverName, command := range driver.SiteCommands() {
+			if strings.ToUpper(driverName) == name {
+				return command
+			}
+		}
+	}
+	return ftpConn.server.siteCommands[name]
+}
+
+// siteCommandNames returns the names of all SITE subcommands, sorted
+func (ftpConn *ftpConn) siteCommandNames() []string {
+	unique := map[string]bool{"HELP": true}
+	for name := range ftpConn.server.siteCommands {
+		unique[name] = true
+	}
+	if driver, ok := ftpConn.driver.(FTPSiteCommandDriver); ok {
+		for name := range driver.SiteCommands() {
+			unique[strings.ToUpper(name)] = true
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reinitialize logs the user out and resets the session to the state of a
+// new connection, which uses driver from now on. Failed login attempts are
+// kept, so they can't be reset by logging out.
+func (ftpConn *ftpConn) reinitialize(driver FTPDriver) {
+	if ftpConn.dataConn != nil {
+		ftpConn.dataConn.Close()
+		ftpConn.dataConn = nil
+	}
+	if ftpConn.user != "" {
+		ftpConn.releaseUser()
+		// the login timeout starts over for the next user
+		ftpConn.loginStart = time.Now()
+	}
+
+	ftpConn.driver = driver
+	ftpConn.namePrefix = "/"
+	ftpConn.reqUser = ""
+	ftpConn.user = ""
+	ftpConn.userOpts = nil
+	ftpConn.userLimits = nil
+	ftpConn.renameFrom = ""
+	ftpConn.dataType = "ASCII"
+	ftpConn.hashAlgorithm = defaultHashAlgorithm
+	ftpConn.hashRange = nil
+}
+
 // receiveLine accepts a single line FTP command and co-ordinates an
 // appropriate response.
 func (ftpConn *ftpConn) receiveLine(line string) error {
@@ -128,7 +282,32 @@ func (ftpConn *ftpConn) receiveLine(line string) error {
 		}
 	}
 
-	cmdObj := commands[command]
+	// commands are answered in order, so everything but the commands that
+	// control the transfer waits until it finished
+	if transfer := ftpConn.activeTransfer(); transfer != nil && !transferCommands[command] {
+		transfer.wait()
+	}
+	ftpConn.resetReplyCode()
+	return ftpConn.intercept(0, command, param)
+}
+
+// intercept runs the interceptor of the server at index i, which may
+// continue with the next one. After the last one the command is executed.
+func (ftpConn *ftpConn) intercept(i int, command string, param string) error {
+	interceptors := ftpConn.server.interceptors
+	if i >= len(interceptors) {
+		return ftpConn.execute(command, param)
+	}
+	return interceptors[i](ftpConn, command, param, func() error {
+		// the interceptor may have replied already
+		ftpConn.resetReplyCode()
+		return ftpConn.intercept(i+1, command, param)
+	})
+}
+
+// execute runs a command after checking that the client may use it
+func (ftpConn *ftpConn) execute(command string, param string) error {
+	cmdObj := ftpConn.server.commands[command]
 	if cmdObj == nil {
 		_, err := ftpConn.writeMessage(500, "Command not found")
 		return err
@@ -143,11 +322,12 @@ func (ftpConn *ftpConn) receiveLine(line string) error {
 		_, err := ftpConn.writeMessage(530, "not logged in")
 		return err
 	}
+	ftpConn.command = command
 	return cmdObj.Execute(ftpConn, param)
 }
 
 func (ftpConn *ftpConn) parseLine(line string) (string, string) {
-	params := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
+	params := strings.SplitN(strings.Trim(stripTelnet(line), "\r\n"), " ", 2)
 	if len(params) == 1 {
 		return params[0], ""
 	}
@@ -156,6 +336,22 @@ func (ftpConn *ftpConn) parseLine(line string) (string, string) {
 
 // writeMessage will send a standard FTP response back to the client.
 func (ftpConn *ftpConn) writeMessage(code int, message string) (int, error) {
+	return ftpConn.writeReply(code, message, true)
+}
+
+// writeTransferMessage sends the final reply of a transfer from its
+// goroutine. Unlike writeMessage it doesn't count as the reply of the command
+// that is executing meanwhile.
+func (ftpConn *ftpConn) writeTransferMessage(code int, message string) (int, error) {
+	return ftpConn.writeReply(code, message, false)
+}
+
+func (ftpConn *ftpConn) writeReply(code int, message string, commandReply bool) (int, error) {
+	ftpConn.writeMu.Lock()
+	defer ftpConn.writeMu.Unlock()
+	if commandReply && ftpConn.replyCode == 0 {
+		ftpConn.replyCode = code
+	}
 	if ftpConn.logger != nil {
 		ftpConn.logger.Debugf("%d %s", code, message)
 	}
@@ -172,6 +368,11 @@ func (ftpConn *ftpConn) writeMessage(code int, message string) (int, error) {
 
 // writeLines will send a multiline FTP response back to the client.
 func (ftpConn *ftpConn) writeLines(code int, lines ...string) (int, error) {
+	ftpConn.writeMu.Lock()
+	defer ftpConn.writeMu.Unlock()
+	if ftpConn.replyCode == 0 {
+		ftpConn.replyCode = code
+	}
 	message := strings.Join(lines, "\r\n") + "\r\n"
 	if ftpConn.logger != nil {
 		ftpConn.logger.Debugf("%d %s", code, message)
@@ -186,6 +387,14 @@ func (ftpConn *ftpConn) writeLines(code int, lines ...string) (int, error) {
 	return wrote, nil
 }
 
+// resetReplyCode forgets the reply code of the previous command, so the next
+// reply that is written is recorded
+func (ftpConn *ftpConn) resetReplyCode() {
+	ftpConn.writeMu.Lock()
+	defer ftpConn.writeMu.Unlock()
+	ftpConn.replyCode = 0
+}
+
 // buildPath takes a client supplied path or filename and generates a safe
 // absolute path within their account sandbox.
 //
@@ -196,14 +405,16 @@ func (ftpConn *ftpConn) writeLines(code int, lines ...string) (int, error) {
 //    buildpath("/files/two.txt")
 //    => "/files/two.txt"
 //    buildpath("files/two.txt")
-//    => "files/two.txt"
+//    => "/files/two.txt"
 //    buildpath("/../../../../etc/passwd")
 //    => "/etc/passwd"
 //
-// The driver implementation is responsible for deciding how to treat this path.
-// Obviously they MUST NOT just read the path off disk. The probably want to
-// prefix the path with something to scope the users access to a sandbox.
+// This is the path as the client sees it. Use driverPath to turn it into the
+// path that is handed to the driver.
 func (ftpConn *ftpConn) buildPath(filename string) (fullPath string) {
+	// backslashes are separators too, so they must be replaced before ".."
+	// is resolved
+	filename = strings.Replace(filename, "\\", "/", -1)
 	if len(filename) > 0 && filename[0] == '/' {
 		fullPath = filepath.Clean(filename)
 	} else if len(filename) > 0 {
@@ -212,10 +423,69 @@ func (ftpConn *ftpConn) buildPath(filename string) (fullPath string) {
 		fullPath = filepath.Clean(ftpConn.namePrefix)
 	}
 	fullPath = strings.Replace(fullPath, "//", "/", -1)
-	fullPath = strings.Replace(fullPath, "\\", "/", -1)
 	return
 }
 
+// driverPath maps a path built by buildPath into the root directory of the
+// logged in user, if they have one.
+//
+//    driverPath("/files/two.txt") with root "/home/bob"
+//    => "/home/bob/files/two.txt"
+//
+// The driver implementation is responsible for deciding how to treat this
+// path. Obviously they MUST NOT just read the path off disk without scoping
+// it, either by giving users a Root in their FTPUserOpts or by prefixing it
+// with something themselves.
+func (ftpConn *ftpConn) driverPath(clientPath string) string {
+	if ftpConn.userOpts == nil || ftpConn.userOpts.Root == "" {
+		return clientPath
+	}
+	// clean the client path as an absolute path first, so it can't escape
+	// from the root
+	return path.Join(ftpConn.userOpts.Root, path.Clean("/"+clientPath))
+}
+
+// maxUploadSize returns the maximum number of bytes the logged in user may
+// upload in a single file, or -1 if uploads are unlimited.
+func (ftpConn *ftpConn) maxUploadSize() int64 {
+	max := ftpConn.server.maxUploadSize
+	if ftpConn.userOpts != nil && ftpConn.userOpts.MaxUploadSize != 0 {
+		max = ftpConn.userOpts.MaxUploadSize
+	}
+	if max <= 0 {
+		return -1
+	}
+	return max
+}
+
+// permitted returns true if the logged in user has permission perm for
+// clientPath. The path is cleaned the same way as by driverPath, so the
+// permissions are checked for the path the driver receives. The temporary
+// files of atomic uploads in progress are off limits.
+func (ftpConn *ftpConn) permitted(perm FTPPermission, clientPath string) bool {
+	clientPath = path.Clean("/" + clientPath)
+	if ftpConn.isPendingUpload(clientPath) {
+		return false
+	}
+	if ftpConn.userOpts == nil {
+		return true
+	}
+	return ftpConn.userOpts.Permissions.Allowed(perm, clientPath)
+}
+
+// permissionDenied tells the client that an operation isn't permitted
+func (ftpConn *ftpConn) permissionDenied() error {
+	_, err := ftpConn.writeMessage(550, "Permission denied")
+	return err
+}
+
+// filenameNotAllowed tells the client why the name it asked for was rejected
+// by the filename policy
+func (ftpConn *ftpConn) filenameNotAllowed(reason error) error {
+	_, err := ftpConn.writeMessage(553, "File name not allowed: "+reason.Error())
+	return err
+}
+
 // the server IP that is being used for this connection. May be the same for all connections,
 // or may vary if the server is listening on 0.0.0.0
 func (ftpConn *ftpConn) localIP() string {
@@ -229,22 +499,42 @@ func (ftpConn *ftpConn) remoteIP() string {
 	return rAddr.IP.String()
 }
 
-// sendOutOfBandData will copy data from reader to the client via the currently
-// open data socket. Assumes the socket is open and ready to be used.
-func (ftpConn *ftpConn) sendOutOfBandReader(reader io.Reader) error {
-	defer ftpConn.dataConn.Close()
+// loadUserOpts asks the driver for the settings of a user that just
+// authenticated. Drivers that don't provide any get the defaults.
+func (ftpConn *ftpConn) loadUserOpts(user string) (*FTPUserOpts, error) {
+	var opts *FTPUserOpts
+	if driver, ok := ftpConn.driver.(FTPUserOptsDriver); ok {
+		var err error
+		if opts, err = driver.UserOpts(user); err != nil {
+			return nil, err
+		}
+	}
+	if opts == nil {
+		opts = &FTPUserOpts{}
+	}
+	return opts, nil
+}
+
+// sendOutOfBandReader will copy data from reader to the client via the data
+// connection of transfer, and closes it afterwards.
+func (ftpConn *ftpConn) sendOutOfBandReader(transfer *ftpTransfer, reader io.Reader) error {
+	defer transfer.dataConn.Close()
 
 	var errs error
-	_, err := io.Copy(ftpConn.dataConn, reader)
+	_, err := io.Copy(transfer.dataConn, transfer.countingReader(ftpConn.downloadReader(reader)))
+	if transfer.isAborted() {
+		_, err := ftpConn.writeTransferMessage(426, "Connection closed; transfer aborted.")
+		return err
+	}
 	if err != nil {
 		errs = multierror.Append(errs, err)
-		if _, err := ftpConn.writeMessage(550, "Action not taken"); err != nil {
+		if _, err := ftpConn.writeTransferMessage(550, "Action not taken"); err != nil {
 			errs = multierror.Append(errs, err)
 		}
 		return errs
 	}
 
-	if _, err := ftpConn.writeMessage(226, "Transfer complete."); err != nil {
+	if _, err := ftpConn.writeTransferMessage(226, "Transfer complete."); err != nil {
 		return err
 	}
 
@@ -253,10 +543,93 @@ func (ftpConn *ftpConn) sendOutOfBandReader(reader io.Reader) error {
 	return nil
 }
 
-// sendOutOfBandData will send a string to the client via the currently open
-// data socket. Assumes the socket is open and ready to be used.
-func (ftpConn *ftpConn) sendOutOfBandData(data string) error {
-	return ftpConn.sendOutOfBandReader(bytes.NewReader([]byte(data)))
+// startTransfer runs the data phase of a transfer in its own goroutine, so
+// the control connection can keep answering the commands in
+// transferCommands meanwhile. The transfer takes over the data connection,
+// which serves a single transfer. command and path describe the transfer in
+// STAT replies. run is expected to send the final reply.
+//
+// While the transfer runs it may read the session state, like the user and
+// their settings. Commands that change it wait until the transfer finished,
+// so only the control goroutine ever writes it.
+//
+// Commands should check for a data connection with dataConnMissing before
+// they prepare the transfer and reply 150, since run isn't called without
+// one.
+func (ftpConn *ftpConn) startTransfer(command string, path string, run func(transfer *ftpTransfer) error) {
+	if ftpConn.dataConn == nil {
+		if err := ftpConn.dataConnMissing(); err != nil && ftpConn.logger != nil {
+			ftpConn.logger.Warnf("failed to reply to client: %s %v", ftpConn.remoteIP(), err)
+		}
+		return
+	}
+
+	transfer := newFtpTransfer(command, path, ftpConn.dataConn)
+	ftpConn.mu.Lock()
+	ftpConn.dataConn = nil
+	ftpConn.transfer = transfer
+	ftpConn.mu.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if ftpConn.logger != nil {
+					ftpConn.logger.Warnf("Recovered in ftpConn transfer %v", r)
+				}
+			}
+			transfer.dataConn.Close()
+			ftpConn.mu.Lock()
+			ftpConn.transfer = nil
+			ftpConn.mu.Unlock()
+			close(transfer.done)
+		}()
+
+		if err := run(transfer); err != nil {
+			if ftpConn.logger != nil {
+				ftpConn.logger.Warnf("failed to transfer data for client: %s %v", ftpConn.remoteIP(), err)
+			}
+		}
+	}()
+}
+
+// dataConnMissing tells the client that it has to open a data connection
+// with PASV, EPSV, PORT or EPRT before a transfer
+func (ftpConn *ftpConn) dataConnMissing() error {
+	_, err := ftpConn.writeMessage(425, "Can't open data connection.")
+	return err
+}
+
+// activeTransfer returns the transfer that is running, or nil
+func (ftpConn *ftpConn) activeTransfer() *ftpTransfer {
+	ftpConn.mu.Lock()
+	defer ftpConn.mu.Unlock()
+	return ftpConn.transfer
+}
+
+// downloadReader applies the download rate limits of the session, the user
+// and the server to reader.
+func (ftpConn *ftpConn) downloadReader(reader io.Reader) io.Reader {
+	limiters := []*RateLimiter{ftpConn.sessionLimits.download, ftpConn.server.rateLimits.download}
+	if ftpConn.userLimits != nil {
+		limiters = append(limiters, ftpConn.userLimits.download)
+	}
+	return newRateLimitedReader(reader, limiters...)
+}
+
+// uploadReader applies the upload rate limits of the session, the user and
+// the server to reader.
+func (ftpConn *ftpConn) uploadReader(reader io.Reader) io.Reader {
+	limiters := []*RateLimiter{ftpConn.sessionLimits.upload, ftpConn.server.rateLimits.upload}
+	if ftpConn.userLimits != nil {
+		limiters = append(limiters, ftpConn.userLimits.upload)
+	}
+	return newRateLimitedReader(reader, limiters...)
+}
+
+// sendOutOfBandData will send a string to the client via the data connection
+// of transfer.
+func (ftpConn *ftpConn) sendOutOfBandData(transfer *ftpTransfer, data string) error {
+	return ftpConn.sendOutOfBandReader(transfer, bytes.NewReader([]byte(data)))
 }
 
 func (ftpConn *ftpConn) newPassiveSocket() (*ftpPassiveSocket, error) {
@@ -265,7 +638,7 @@ func (ftpConn *ftpConn) newPassiveSocket() (*ftpPassiveSocket, error) {
 		ftpConn.dataConn = nil
 	}
 
-	socket, err := newPassiveSocket(ftpConn.localIP(), ftpConn.minDataPort, ftpConn.maxDataPort, ftpConn.logger)
+	socket, err := newPassiveSocket(ftpConn.localIP(), ftpConn.minDataPort, ftpConn.maxDataPort, ftpConn.server.dataConnectionTimeout, ftpConn.server.dataTransferTimeout, ftpConn.logger)
 	if err != nil {
 		return nil, err
 	}
@@ -280,7 +653,7 @@ func (ftpConn *ftpConn) newActiveSocket(host string, port uint16) (*ftpActiveSoc
 		ftpConn.dataConn = nil
 	}
 
-	socket, err := newActiveSocket(host, port, ftpConn.logger)
+	socket, err := newActiveSocket(host, port, ftpConn.server.dataConnectionTimeout, ftpConn.server.dataTransferTimeout, ftpConn.logger)
 	if err != nil {
 		return nil, err
 	}
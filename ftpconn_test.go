@@ -0,0 +1,1625 @@
+package graval
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testDriver is an in-memory FTPDriver used to exercise ftpConn. Paths of
+// directories are stored without a trailing slash, the root is "/".
+type testDriver struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	dirs     map[string]bool
+	userOpts *FTPUserOpts
+	aborted  []string
+	modTimes map[string]time.Time
+	created  map[string]time.Time
+	modes    map[string]os.FileMode
+	open     int
+}
+
+func newTestDriver() *testDriver {
+	driver := new(testDriver)
+	driver.files = map[string][]byte{}
+	driver.dirs = map[string]bool{"/": true}
+	driver.modTimes = map[string]time.Time{}
+	driver.created = map[string]time.Time{}
+	driver.modes = map[string]os.FileMode{}
+	return driver
+}
+
+func (driver *testDriver) Authenticate(user string, pass string, _ string) (bool, error) {
+	return pass == "secret", nil
+}
+
+func (driver *testDriver) UserOpts(user string) (*FTPUserOpts, error) {
+	return driver.userOpts, nil
+}
+
+func (driver *testDriver) Bytes(path string) (int64, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	data, ok := driver.files[path]
+	if !ok {
+		return -1, nil
+	}
+	return int64(len(data)), nil
+}
+
+func (driver *testDriver) ModifiedTime(path string) (time.Time, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if modTime, ok := driver.modTimes[path]; ok {
+		return modTime, nil
+	}
+	return time.Unix(1566738000, 0), nil
+}
+
+func (driver *testDriver) SetModifiedTime(path string, modTime time.Time) error {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if _, ok := driver.files[path]; !ok {
+		return os.ErrNotExist
+	}
+	driver.modTimes[path] = modTime
+	return nil
+}
+
+func (driver *testDriver) SetCreationTime(path string, createTime time.Time) error {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if _, ok := driver.files[path]; !ok {
+		return os.ErrNotExist
+	}
+	driver.created[path] = createTime
+	return nil
+}
+
+func (driver *testDriver) ChangeDir(path string) (bool, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return driver.dirs[path], nil
+}
+
+func (driver *testDriver) DirContents(dir string) ([]os.FileInfo, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	var files []os.FileInfo
+	for name := range driver.dirs {
+		if name != "/" && path.Dir(name) == dir {
+			files = append(files, NewDirItem(path.Base(name), time.Unix(1566738000, 0)))
+		}
+	}
+	for name, data := range driver.files {
+		if path.Dir(name) == dir {
+			files = append(files, NewFileItem(path.Base(name), int64(len(data)), time.Unix(1566738000, 0)))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+func (driver *testDriver) DeleteDir(path string) (bool, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if !driver.dirs[path] {
+		return false, nil
+	}
+	delete(driver.dirs, path)
+	return true, nil
+}
+
+func (driver *testDriver) DeleteFile(path string) (bool, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if _, ok := driver.files[path]; !ok {
+		return false, nil
+	}
+	delete(driver.files, path)
+	return true, nil
+}
+
+func (driver *testDriver) Rename(fromPath string, toPath string) (bool, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	data, ok := driver.files[fromPath]
+	if !ok {
+		return false, nil
+	}
+	delete(driver.files, fromPath)
+	driver.files[toPath] = data
+	return true, nil
+}
+
+func (driver *testDriver) MakeDir(path string) (bool, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	driver.dirs[path] = true
+	return true, nil
+}
+
+func (driver *testDriver) GetFile(path string) (io.ReadCloser, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	data, ok := driver.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	driver.open++
+	return &testFileReader{Reader: bytes.NewReader(data), driver: driver}, nil
+}
+
+// testFileReader counts the files of a testDriver that are open
+type testFileReader struct {
+	io.Reader
+	driver *testDriver
+}
+
+func (reader *testFileReader) Close() error {
+	reader.driver.mu.Lock()
+	defer reader.driver.mu.Unlock()
+	reader.driver.open--
+	return nil
+}
+
+func (driver *testDriver) PutFile(path string, reader io.Reader) (bool, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return false, err
+	}
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	driver.files[path] = data
+	return true, nil
+}
+
+func (driver *testDriver) AbortUpload(path string, reason error) error {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	driver.aborted = append(driver.aborted, path)
+	return nil
+}
+
+func (driver *testDriver) Chmod(path string, mode os.FileMode) error {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if _, ok := driver.files[path]; !ok {
+		return os.ErrNotExist
+	}
+	driver.modes[path] = mode
+	return nil
+}
+
+func (driver *testDriver) file(path string) (string, bool) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	data, ok := driver.files[path]
+	return string(data), ok
+}
+
+func (driver *testDriver) setFile(path string, data string) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	driver.files[path] = []byte(data)
+}
+
+func (driver *testDriver) openFiles() int {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return driver.open
+}
+
+func (driver *testDriver) fileCount() int {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return len(driver.files)
+}
+
+func (driver *testDriver) abortedUploads() []string {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return append([]string(nil), driver.aborted...)
+}
+
+func (driver *testDriver) modifiedTime(path string) time.Time {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return driver.modTimes[path]
+}
+
+func (driver *testDriver) creationTime(path string) time.Time {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return driver.created[path]
+}
+
+func (driver *testDriver) mode(path string) os.FileMode {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return driver.modes[path]
+}
+
+type testDriverFactory struct {
+	driver FTPDriver
+}
+
+func (factory *testDriverFactory) NewDriver() (FTPDriver, error) {
+	return factory.driver, nil
+}
+
+// testClient is the client side of a control connection served by an
+// ftpConn that was set up by newTestClient.
+type testClient struct {
+	*textproto.Conn
+	t      *testing.T
+	server *FTPServer
+}
+
+// newTestClient serves a single control connection on the loopback
+// interface using a server configured with opts, and returns a client
+// connected to it that already received the welcome message.
+func newTestClient(t *testing.T, driver FTPDriver, opts *FTPServerOpts) *testClient {
+	if opts == nil {
+		opts = &FTPServerOpts{}
+	}
+	opts.Factory = &testDriverFactory{driver: driver}
+	server := NewFTPServer(opts)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		tcpConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		newFtpConn(tcpConn, driver, server).Serve()
+	}()
+
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &testClient{Conn: conn, t: t, server: server}
+	client.expect(220)
+	return client
+}
+
+// cmd sends a command and returns the code and message of the reply
+func (client *testClient) cmd(format string, args ...interface{}) (int, string) {
+	if err := client.PrintfLine(format, args...); err != nil {
+		client.t.Fatal(err)
+	}
+	return client.reply()
+}
+
+func (client *testClient) reply() (int, string) {
+	code, message, err := client.ReadResponse(0)
+	if err != nil && code == 0 {
+		client.t.Fatal(err)
+	}
+	return code, message
+}
+
+func (client *testClient) expect(code int) string {
+	got, message := client.reply()
+	if got != code {
+		client.t.Fatalf("expected reply %d, got %d %s", code, got, message)
+	}
+	return message
+}
+
+func (client *testClient) login() {
+	client.cmd("USER test")
+	if code, message := client.cmd("PASS secret"); code != 230 {
+		client.t.Fatalf("login failed: %d %s", code, message)
+	}
+}
+
+// pasv opens a passive data connection
+func (client *testClient) pasv() net.Conn {
+	code, message := client.cmd("EPSV")
+	if code != 229 {
+		client.t.Fatalf("EPSV failed: %d %s", code, message)
+	}
+	port := strings.TrimSuffix(message[strings.Index(message, "(|||")+4:], "|)")
+	dataConn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return dataConn
+}
+
+func TestPassAttempts(t *testing.T) {
+	Convey("Logging in with a wrong password", t, func() {
+		opts := &FTPServerOpts{MaxLoginAttempts: 2, LoginFailureDelay: time.Millisecond}
+		client := newTestClient(t, newTestDriver(), opts)
+		defer client.Close()
+
+		Convey("Will allow the client to try again", func() {
+			client.cmd("USER test")
+			code, _ := client.cmd("PASS wrong")
+			So(code, ShouldEqual, 530)
+			code, _ = client.cmd("PASS secret")
+			So(code, ShouldEqual, 230)
+		})
+
+		Convey("Will disconnect the client after the last attempt", func() {
+			client.cmd("USER test")
+			code, _ := client.cmd("PASS wrong")
+			So(code, ShouldEqual, 530)
+			code, _ = client.cmd("PASS wrong")
+			So(code, ShouldEqual, 530)
+			code, _ = client.reply()
+			So(code, ShouldEqual, 221)
+			_, _, err := client.ReadResponse(0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestUserIPFilter(t *testing.T) {
+	Convey("Logging in as a user restricted to other addresses", t, func() {
+		driver := newTestDriver()
+		filter, _ := NewFTPIPFilter([]string{"192.0.2.0/24"}, nil)
+		driver.userOpts = &FTPUserOpts{IPFilter: filter}
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+
+		Convey("Will be refused", func() {
+			client.cmd("USER test")
+			code, _ := client.cmd("PASS secret")
+			So(code, ShouldEqual, 530)
+			code, _ = client.reply()
+			So(code, ShouldEqual, 221)
+		})
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	Convey("A client that doesn't log in", t, func() {
+		opts := &FTPServerOpts{LoginTimeout: 200 * time.Millisecond}
+		client := newTestClient(t, newTestDriver(), opts)
+		defer client.Close()
+
+		Convey("Will be disconnected after the login timeout", func() {
+			code, message := client.reply()
+			So(code, ShouldEqual, 421)
+			So(message, ShouldContainSubstring, "Login timeout")
+		})
+	})
+
+	Convey("A client that stays idle", t, func() {
+		opts := &FTPServerOpts{IdleTimeout: 200 * time.Millisecond}
+		client := newTestClient(t, newTestDriver(), opts)
+		defer client.Close()
+		client.login()
+
+		Convey("Will be disconnected after the idle timeout", func() {
+			code, _ := client.reply()
+			So(code, ShouldEqual, 421)
+		})
+	})
+}
+
+func TestTransfers(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will be able to upload a file", func() {
+			dataConn := client.pasv()
+			code, _ := client.cmd("STOR upload.txt")
+			So(code, ShouldEqual, 150)
+			dataConn.Write([]byte("hello world"))
+			dataConn.Close()
+			client.expect(226)
+			data, _ := driver.file("/upload.txt")
+			So(data, ShouldEqual, "hello world")
+		})
+
+		Convey("Will be able to download a file", func() {
+			driver.setFile("/download.txt", "some content")
+			dataConn := client.pasv()
+			code, _ := client.cmd("RETR download.txt")
+			So(code, ShouldEqual, 150)
+			data, err := ioutil.ReadAll(dataConn)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "some content")
+			client.expect(226)
+		})
+	})
+}
+
+type testQuotaProvider struct {
+	mu    sync.Mutex
+	quota FTPQuota
+}
+
+func (provider *testQuotaProvider) Quota(user string) (*FTPQuota, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	quota := provider.quota
+	return &quota, nil
+}
+
+func (provider *testQuotaProvider) AddUsage(user string, bytes int64, files int64) error {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.quota.UsedBytes += bytes
+	provider.quota.UsedFiles += files
+	return nil
+}
+
+// usage returns the number of bytes and files the user uses
+func (provider *testQuotaProvider) usage() (int64, int64) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	return provider.quota.UsedBytes, provider.quota.UsedFiles
+}
+
+func TestQuota(t *testing.T) {
+	Convey("A client with a storage quota", t, func() {
+		driver := newTestDriver()
+		quota := &testQuotaProvider{quota: FTPQuota{MaxBytes: 10, MaxFiles: 2, UsedFiles: 1}}
+		client := newTestClient(t, driver, &FTPServerOpts{QuotaProvider: quota})
+		defer client.Close()
+		client.login()
+
+		Convey("Will report the available space", func() {
+			code, message := client.cmd("AVBL")
+			So(code, ShouldEqual, 213)
+			So(message, ShouldEqual, "10")
+		})
+
+		Convey("Will be able to upload within the quota", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR small.txt")
+			dataConn.Write([]byte("0123456789"))
+			dataConn.Close()
+			client.expect(226)
+			usedBytes, usedFiles := quota.usage()
+			So(usedBytes, ShouldEqual, 10)
+			So(usedFiles, ShouldEqual, 2)
+
+			Convey("But not store more files", func() {
+				client.pasv().Close()
+				code, _ := client.cmd("STOR another.txt")
+				So(code, ShouldEqual, 552)
+			})
+		})
+
+		Convey("Will abort uploads that exceed the quota", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR big.txt")
+			dataConn.Write([]byte("0123456789abcdef"))
+			dataConn.Close()
+			client.expect(552)
+			_, stored := driver.file("/big.txt")
+			So(stored, ShouldBeFalse)
+			usedBytes, _ := quota.usage()
+			So(usedBytes, ShouldEqual, 0)
+		})
+	})
+
+	Convey("A client with a storage quota and stored files", t, func() {
+		driver := newTestDriver()
+		driver.setFile("/file.txt", "content")
+		driver.setFile("/other.txt", "other")
+		quota := &testQuotaProvider{quota: FTPQuota{MaxBytes: 100, UsedBytes: 12, MaxFiles: 10, UsedFiles: 2}}
+		client := newTestClient(t, driver, &FTPServerOpts{QuotaProvider: quota})
+		defer client.Close()
+		client.login()
+
+		Convey("Will free the space of deleted files", func() {
+			code, _ := client.cmd("DELE file.txt")
+			So(code, ShouldEqual, 250)
+			usedBytes, usedFiles := quota.usage()
+			So(usedBytes, ShouldEqual, 5)
+			So(usedFiles, ShouldEqual, 1)
+		})
+
+		Convey("Will only count the change in size of overwritten files", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR file.txt")
+			dataConn.Write([]byte("new"))
+			dataConn.Close()
+			client.expect(226)
+			usedBytes, usedFiles := quota.usage()
+			So(usedBytes, ShouldEqual, 8)
+			So(usedFiles, ShouldEqual, 2)
+		})
+
+		Convey("Will free the space of files replaced by a rename", func() {
+			client.cmd("RNFR other.txt")
+			code, _ := client.cmd("RNTO file.txt")
+			So(code, ShouldEqual, 250)
+			usedBytes, usedFiles := quota.usage()
+			So(usedBytes, ShouldEqual, 5)
+			So(usedFiles, ShouldEqual, 1)
+		})
+
+		Convey("Will keep the space of files renamed to themselves", func() {
+			client.cmd("RNFR file.txt")
+			code, _ := client.cmd("RNTO /file.txt")
+			So(code, ShouldEqual, 250)
+			usedBytes, usedFiles := quota.usage()
+			So(usedBytes, ShouldEqual, 12)
+			So(usedFiles, ShouldEqual, 2)
+		})
+	})
+
+	Convey("A client without a storage quota", t, func() {
+		client := newTestClient(t, newTestDriver(), nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will not know the available space", func() {
+			code, _ := client.cmd("AVBL")
+			So(code, ShouldEqual, 550)
+		})
+	})
+}
+
+func TestPermissionChecks(t *testing.T) {
+	Convey("A client with read only permissions", t, func() {
+		driver := newTestDriver()
+		driver.setFile("/file.txt", "content")
+		driver.userOpts = &FTPUserOpts{Permissions: &FTPPermissions{Default: PermReadOnly}}
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will not be able to delete files", func() {
+			code, _ := client.cmd("DELE file.txt")
+			So(code, ShouldEqual, 550)
+			_, exists := driver.file("/file.txt")
+			So(exists, ShouldBeTrue)
+		})
+
+		Convey("Will not be able to upload files", func() {
+			code, _ := client.cmd("STOR new.txt")
+			So(code, ShouldEqual, 550)
+		})
+
+		Convey("Will be able to download files", func() {
+			dataConn := client.pasv()
+			code, _ := client.cmd("RETR file.txt")
+			So(code, ShouldEqual, 150)
+			ioutil.ReadAll(dataConn)
+			client.expect(226)
+		})
+	})
+}
+
+func TestPermissionRules(t *testing.T) {
+	Convey("A client that may change but not overwrite files in a public directory", t, func() {
+		driver := newTestDriver()
+		driver.dirs["/srv"] = true
+		driver.dirs["/srv/public"] = true
+		driver.dirs["/srv/secret"] = true
+		driver.setFile("/srv/secret/file.txt", "secret")
+		driver.userOpts = &FTPUserOpts{Root: "/srv", Permissions: &FTPPermissions{
+			Default: PermReadOnly,
+			Rules:   []FTPPathPermissions{{Path: "/public", Permissions: PermAll &^ PermOverwrite}},
+		}}
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will not be able to leave it with a backslash", func() {
+			code, _ := client.cmd("DELE public/..\\secret/file.txt")
+			So(code, ShouldEqual, 550)
+			_, exists := driver.file("/srv/secret/file.txt")
+			So(exists, ShouldBeTrue)
+		})
+
+		Convey("Will not be able to replace files by renaming", func() {
+			driver.setFile("/srv/public/a.txt", "a")
+			driver.setFile("/srv/public/b.txt", "b")
+			client.cmd("RNFR public/a.txt")
+			code, _ := client.cmd("RNTO public/b.txt")
+			So(code, ShouldEqual, 550)
+			data, _ := driver.file("/srv/public/b.txt")
+			So(data, ShouldEqual, "b")
+
+			client.cmd("RNFR public/a.txt")
+			code, _ = client.cmd("RNTO public/c.txt")
+			So(code, ShouldEqual, 250)
+		})
+
+		Convey("Will have backslashes treated as separators", func() {
+			code, _ := client.cmd("MKD public\\new")
+			So(code, ShouldEqual, 257)
+			code, _ = client.cmd("MKD secret\\new")
+			So(code, ShouldEqual, 550)
+		})
+	})
+}
+
+func TestUserRoot(t *testing.T) {
+	Convey("A client with a root directory", t, func() {
+		driver := newTestDriver()
+		driver.dirs["/home"] = true
+		driver.dirs["/home/bob"] = true
+		driver.setFile("/home/bob/file.txt", "bob's file")
+		driver.setFile("/secret.txt", "secret")
+		driver.userOpts = &FTPUserOpts{Root: "/home/bob"}
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will see the root directory as /", func() {
+			code, message := client.cmd("CWD /")
+			So(code, ShouldEqual, 250)
+			So(message, ShouldEqual, "Directory changed to /")
+			code, message = client.cmd("SIZE file.txt")
+			So(code, ShouldEqual, 213)
+			So(message, ShouldEqual, "10")
+		})
+
+		Convey("Will not be able to escape from the root directory", func() {
+			code, _ := client.cmd("CWD ..")
+			So(code, ShouldEqual, 250)
+			_, message := client.cmd("PWD")
+			So(message, ShouldEqual, "\"/\" is the current directory")
+			code, _ = client.cmd("SIZE ../../secret.txt")
+			So(code, ShouldEqual, 450)
+		})
+
+		Convey("Will upload into the root directory", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR upload.txt")
+			dataConn.Write([]byte("uploaded"))
+			dataConn.Close()
+			client.expect(226)
+			data, _ := driver.file("/home/bob/upload.txt")
+			So(data, ShouldEqual, "uploaded")
+		})
+	})
+}
+
+func TestFilenamePolicyChecks(t *testing.T) {
+	Convey("A client on a server with a filename policy", t, func() {
+		driver := newTestDriver()
+		opts := &FTPServerOpts{FilenamePolicy: &FTPFilenamePolicy{Deny: []string{"*.exe"}}}
+		client := newTestClient(t, driver, opts)
+		defer client.Close()
+		client.login()
+
+		Convey("Will not be able to upload forbidden names", func() {
+			code, message := client.cmd("STOR virus.exe")
+			So(code, ShouldEqual, 553)
+			So(message, ShouldContainSubstring, "virus.exe")
+		})
+
+		Convey("Will not be able to create forbidden directories", func() {
+			code, _ := client.cmd("MKD dir.exe")
+			So(code, ShouldEqual, 553)
+		})
+
+		Convey("Will not be able to rename to forbidden names", func() {
+			driver.setFile("/file.txt", "content")
+			code, _ := client.cmd("RNFR file.txt")
+			So(code, ShouldEqual, 350)
+			code, _ = client.cmd("RNTO file.exe")
+			So(code, ShouldEqual, 553)
+		})
+	})
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	Convey("A client on a server with a maximum upload size", t, func() {
+		driver := newTestDriver()
+		client := newTestClient(t, driver, &FTPServerOpts{MaxUploadSize: 5})
+		defer client.Close()
+		client.login()
+
+		Convey("Will be able to upload small files", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR small.txt")
+			dataConn.Write([]byte("12345"))
+			dataConn.Close()
+			client.expect(226)
+		})
+
+		Convey("Will have large uploads aborted", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR large.txt")
+			dataConn.Write([]byte("123456"))
+			dataConn.Close()
+			message := client.expect(552)
+			So(message, ShouldEqual, "Exceeded maximum upload size")
+			So(driver.abortedUploads(), ShouldResemble, []string{"/large.txt"})
+		})
+	})
+
+	Convey("A client allowed to upload more than the server default", t, func() {
+		driver := newTestDriver()
+		driver.userOpts = &FTPUserOpts{MaxUploadSize: -1}
+		client := newTestClient(t, driver, &FTPServerOpts{MaxUploadSize: 5})
+		defer client.Close()
+		client.login()
+
+		Convey("Will be able to upload large files", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR large.txt")
+			dataConn.Write([]byte("123456"))
+			dataConn.Close()
+			client.expect(226)
+		})
+	})
+}
+
+func TestAtomicUploads(t *testing.T) {
+	Convey("A client on a server with atomic uploads", t, func() {
+		driver := newTestDriver()
+		opts := &FTPServerOpts{AtomicUploads: true, MaxUploadSize: 10}
+		client := newTestClient(t, driver, opts)
+		defer client.Close()
+		client.login()
+
+		Convey("Will have completed uploads renamed to the target", func() {
+			dataConn := client.pasv()
+			client.cmd("STOR file.txt")
+			dataConn.Write([]byte("content"))
+			dataConn.Close()
+			client.expect(226)
+			data, _ := driver.file("/file.txt")
+			So(data, ShouldEqual, "content")
+			So(driver.fileCount(), ShouldEqual, 1)
+		})
+
+		Convey("Will have failed uploads deleted", func() {
+			driver.setFile("/file.txt", "old content")
+			dataConn := client.pasv()
+			client.cmd("STOR file.txt")
+			dataConn.Write([]byte("far too much content"))
+			dataConn.Close()
+			client.expect(552)
+			data, _ := driver.file("/file.txt")
+			So(data, ShouldEqual, "old content")
+			So(driver.fileCount(), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestAbort(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		client := newTestClient(t, driver, &FTPServerOpts{DownloadRateLimit: 1000})
+		defer client.Close()
+		client.login()
+
+		Convey("Will be able to abort a download", func() {
+			driver.setFile("/big.bin", strings.Repeat("x", 100000))
+			dataConn := client.pasv()
+			defer dataConn.Close()
+			code, _ := client.cmd("RETR big.bin")
+			So(code, ShouldEqual, 150)
+
+			// clients send Telnet "Interrupt Process" and "Synch" first
+			client.PrintfLine("\xff\xf4\xff\xf2ABOR")
+			client.expect(426)
+			client.expect(226)
+
+			code, _ = client.cmd("NOOP")
+			So(code, ShouldEqual, 200)
+		})
+
+		Convey("Will be able to abort a download with the Synch of BSD clients", func() {
+			driver.setFile("/big.bin", strings.Repeat("x", 100000))
+			dataConn := client.pasv()
+			defer dataConn.Close()
+			code, _ := client.cmd("RETR big.bin")
+			So(code, ShouldEqual, 150)
+
+			// the IAC of the Synch is sent as urgent data, which the socket
+			// drops, so only the Data Mark arrives in front of ABOR
+			client.PrintfLine("\xff\xf4\xf2ABOR")
+			client.expect(426)
+			client.expect(226)
+		})
+
+		Convey("Will be able to abort an upload", func() {
+			dataConn := client.pasv()
+			defer dataConn.Close()
+			code, _ := client.cmd("STOR upload.txt")
+			So(code, ShouldEqual, 150)
+			dataConn.Write([]byte("partial"))
+
+			client.PrintfLine("ABOR")
+			client.expect(426)
+			client.expect(226)
+			So(driver.abortedUploads(), ShouldResemble, []string{"/upload.txt"})
+			_, exists := driver.file("/upload.txt")
+			So(exists, ShouldBeFalse)
+		})
+
+		Convey("Will get a reply to ABOR without a transfer", func() {
+			code, _ := client.cmd("ABOR")
+			So(code, ShouldEqual, 226)
+		})
+	})
+}
+
+func TestCommandsDuringTransfer(t *testing.T) {
+	Convey("A client that is downloading a file", t, func() {
+		driver := newTestDriver()
+		driver.setFile("/big.bin", strings.Repeat("x", 1500))
+		client := newTestClient(t, driver, &FTPServerOpts{DownloadRateLimit: 1000})
+		defer client.Close()
+		client.login()
+		dataConn := client.pasv()
+		defer dataConn.Close()
+		code, _ := client.cmd("RETR big.bin")
+		So(code, ShouldEqual, 150)
+
+		Convey("Will get a reply to NOOP right away", func() {
+			code, _ := client.cmd("NOOP")
+			So(code, ShouldEqual, 200)
+			client.PrintfLine("ABOR")
+			client.expect(426)
+			client.expect(226)
+		})
+
+		Convey("Will get other replies after the transfer completed", func() {
+			received := make(chan []byte)
+			go func() {
+				data, _ := ioutil.ReadAll(dataConn)
+				received <- data
+			}()
+			client.PrintfLine("PWD")
+			client.expect(226)
+			client.expect(257)
+			So(len(<-received), ShouldEqual, 1500)
+		})
+
+		Convey("Will be disconnected after the transfer completed on QUIT", func() {
+			go ioutil.ReadAll(dataConn)
+			client.PrintfLine("QUIT")
+			client.expect(226)
+			client.expect(221)
+		})
+	})
+
+	Convey("A client without a data connection", t, func() {
+		driver := newTestDriver()
+		driver.setFile("/download.txt", "some content")
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will be told it can't be opened before a transfer starts", func() {
+			for _, command := range []string{"RETR download.txt", "STOR upload.txt", "STOU", "LIST", "NLST"} {
+				code, _ := client.cmd(command)
+				So(code, ShouldEqual, 425)
+			}
+			So(driver.openFiles(), ShouldEqual, 0)
+			_, stored := driver.file("/upload.txt")
+			So(stored, ShouldBeFalse)
+		})
+	})
+}
+
+func TestStat(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		driver.dirs["/docs"] = true
+		driver.setFile("/docs/readme.txt", "read me")
+		client := newTestClient(t, driver, &FTPServerOpts{DownloadRateLimit: 1000})
+		defer client.Close()
+		client.login()
+
+		Convey("Will get the status of the session", func() {
+			client.cmd("TYPE I")
+			client.cmd("CWD docs")
+			code, message := client.cmd("STAT")
+			So(code, ShouldEqual, 211)
+			So(message, ShouldContainSubstring, "Logged in as test")
+			So(message, ShouldContainSubstring, "Current directory: /docs")
+			So(message, ShouldContainSubstring, "TYPE: Binary")
+			So(message, ShouldContainSubstring, "No data connection")
+		})
+
+		Convey("Will get the progress of a running transfer", func() {
+			driver.setFile("/big.bin", strings.Repeat("x", 1500))
+			dataConn := client.pasv()
+			defer dataConn.Close()
+			code, _ := client.cmd("RETR big.bin")
+			So(code, ShouldEqual, 150)
+
+			code, message := client.cmd("STAT")
+			So(code, ShouldEqual, 211)
+			So(message, ShouldContainSubstring, "RETR /big.bin")
+			client.PrintfLine("ABOR")
+			client.expect(426)
+			client.expect(226)
+		})
+
+		Convey("Will get a listing of a directory", func() {
+			code, message := client.cmd("STAT /docs")
+			So(code, ShouldEqual, 213)
+			So(message, ShouldContainSubstring, "readme.txt")
+		})
+	})
+
+	Convey("A client that isn't logged in", t, func() {
+		client := newTestClient(t, newTestDriver(), nil)
+		defer client.Close()
+
+		Convey("Will get the status of the session", func() {
+			code, message := client.cmd("STAT")
+			So(code, ShouldEqual, 211)
+			So(message, ShouldContainSubstring, "Not logged in")
+		})
+
+		Convey("Will not get a listing", func() {
+			code, _ := client.cmd("STAT /")
+			So(code, ShouldEqual, 530)
+		})
+	})
+}
+
+func TestHelp(t *testing.T) {
+	Convey("A client", t, func() {
+		client := newTestClient(t, newTestDriver(), nil)
+		defer client.Close()
+
+		Convey("Will get a list of the commands", func() {
+			code, message := client.cmd("HELP")
+			So(code, ShouldEqual, 214)
+			So(message, ShouldContainSubstring, "RETR")
+			So(message, ShouldContainSubstring, "HELP")
+		})
+
+		Convey("Will get the syntax of a command", func() {
+			code, message := client.cmd("HELP cwd")
+			So(code, ShouldEqual, 214)
+			So(message, ShouldEqual, "Syntax: CWD <path>")
+		})
+
+		Convey("Will be told about unknown commands", func() {
+			code, _ := client.cmd("HELP FOO")
+			So(code, ShouldEqual, 502)
+		})
+	})
+}
+
+func TestRein(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		driver.dirs["/docs"] = true
+		client := newTestClient(t, driver, &FTPServerOpts{MaxSessionsPerUser: 1})
+		defer client.Close()
+		client.login()
+		client.cmd("CWD docs")
+
+		Convey("Will be logged out by REIN", func() {
+			code, _ := client.cmd("REIN")
+			So(code, ShouldEqual, 220)
+			code, _ = client.cmd("PWD")
+			So(code, ShouldEqual, 530)
+		})
+
+		Convey("Will be able to log in again after REIN", func() {
+			client.cmd("REIN")
+			client.login()
+			_, message := client.cmd("PWD")
+			So(message, ShouldStartWith, "\"/\"")
+		})
+
+		Convey("Will have to use REIN to log in as another user", func() {
+			code, _ := client.cmd("USER other")
+			So(code, ShouldEqual, 503)
+			code, _ = client.cmd("PASS secret")
+			So(code, ShouldEqual, 503)
+			So(client.server.Stats().SessionsPerUser, ShouldResemble, map[string]int{"test": 1})
+
+			client.cmd("REIN")
+			So(client.server.Stats().SessionsPerUser, ShouldBeEmpty)
+			upload, download := client.server.UserRateLimiters("test")
+			So(upload, ShouldBeNil)
+			So(download, ShouldBeNil)
+		})
+	})
+}
+
+func TestStou(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		driver.dirs["/scans"] = true
+		driver.setFile("/scans/scan.pdf", "first")
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+		client.cmd("CWD scans")
+
+		Convey("Will upload under a generated name", func() {
+			dataConn := client.pasv()
+			code, message := client.cmd("STOU")
+			So(code, ShouldEqual, 150)
+			So(message, ShouldStartWith, "FILE: ftp")
+			name := strings.TrimPrefix(message, "FILE: ")
+			dataConn.Write([]byte("content"))
+			dataConn.Close()
+			So(client.expect(226), ShouldContainSubstring, name)
+			data, _ := driver.file("/scans/" + name)
+			So(data, ShouldEqual, "content")
+		})
+
+		Convey("Will not replace an existing file with a suggested name", func() {
+			dataConn := client.pasv()
+			code, message := client.cmd("STOU scan.pdf")
+			So(code, ShouldEqual, 150)
+			So(message, ShouldEqual, "FILE: scan.pdf.1")
+			dataConn.Write([]byte("second"))
+			dataConn.Close()
+			client.expect(226)
+			data, _ := driver.file("/scans/scan.pdf")
+			So(data, ShouldEqual, "first")
+			data, _ = driver.file("/scans/scan.pdf.1")
+			So(data, ShouldEqual, "second")
+		})
+	})
+}
+
+func TestFileTimes(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		driver.setFile("/photo.jpg", "jpeg")
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+		expected := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+
+		Convey("Will see MFMT and MFCT in the features", func() {
+			_, message := client.cmd("FEAT")
+			So(message, ShouldContainSubstring, "MFMT")
+			So(message, ShouldContainSubstring, "MFCT")
+		})
+
+		Convey("Will be able to set the modification time with MFMT", func() {
+			code, message := client.cmd("MFMT 20200102150405 photo.jpg")
+			So(code, ShouldEqual, 213)
+			So(message, ShouldEqual, "Modify=20200102150405; photo.jpg")
+			So(driver.modifiedTime("/photo.jpg"), ShouldEqual, expected)
+			_, message = client.cmd("MDTM photo.jpg")
+			So(message, ShouldEqual, "20200102150405")
+		})
+
+		Convey("Will be able to set the modification time with MDTM", func() {
+			code, _ := client.cmd("MDTM 20200102150405.123 photo.jpg")
+			So(code, ShouldEqual, 213)
+			So(driver.modifiedTime("/photo.jpg"), ShouldEqual, expected.Add(123*time.Millisecond))
+		})
+
+		Convey("Will be able to set the creation time with MFCT", func() {
+			code, message := client.cmd("MFCT 20200102150405 photo.jpg")
+			So(code, ShouldEqual, 213)
+			So(message, ShouldEqual, "Create=20200102150405; photo.jpg")
+			So(driver.creationTime("/photo.jpg"), ShouldEqual, expected)
+		})
+
+		Convey("Will get an error for a malformed time", func() {
+			code, _ := client.cmd("MFMT yesterday photo.jpg")
+			So(code, ShouldEqual, 501)
+		})
+
+		Convey("Will get an error for a missing file", func() {
+			code, _ := client.cmd("MFMT 20200102150405 missing.jpg")
+			So(code, ShouldEqual, 550)
+		})
+	})
+}
+
+func TestParseFileTime(t *testing.T) {
+	Convey("Parsing the parameter of MFMT", t, func() {
+		Convey("Will split the time and the path", func() {
+			fileTime, filePath, ok := parseFileTime("20200102150405 a file.txt")
+			So(ok, ShouldBeTrue)
+			So(fileTime, ShouldEqual, time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC))
+			So(filePath, ShouldEqual, "a file.txt")
+		})
+
+		Convey("Will reject a plain path", func() {
+			_, _, ok := parseFileTime("a file.txt")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Will reject a time without a path", func() {
+			_, _, ok := parseFileTime("20200102150405")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestHash(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		driver.setFile("/file.txt", "hello world")
+		client := newTestClient(t, driver, nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will get the hash of a file", func() {
+			code, message := client.cmd("HASH file.txt")
+			So(code, ShouldEqual, 213)
+			So(message, ShouldEqual, "SHA-256 0-11 b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9 file.txt")
+		})
+
+		Convey("Will be able to select the algorithm", func() {
+			code, message := client.cmd("OPTS HASH MD5")
+			So(code, ShouldEqual, 200)
+			So(message, ShouldEqual, "MD5")
+			_, message = client.cmd("HASH file.txt")
+			So(message, ShouldEqual, "MD5 0-11 5eb63bbbe01eeed093cb22bb8f5acdc3 file.txt")
+			code, _ = client.cmd("OPTS HASH FOO")
+			So(code, ShouldEqual, 501)
+		})
+
+		Convey("Will get the hash of a range", func() {
+			code, _ := client.cmd("RANG 6 11")
+			So(code, ShouldEqual, 350)
+			client.cmd("OPTS HASH MD5")
+			_, message := client.cmd("HASH file.txt")
+			So(message, ShouldEqual, "MD5 6-11 7d793037a0760186574b0282f2f435e7 file.txt")
+			// the range only applies once
+			_, message = client.cmd("HASH file.txt")
+			So(message, ShouldStartWith, "MD5 0-11 ")
+		})
+
+		Convey("Will get hashes with the legacy commands", func() {
+			code, message := client.cmd("XMD5 file.txt")
+			So(code, ShouldEqual, 250)
+			So(message, ShouldEqual, "5eb63bbbe01eeed093cb22bb8f5acdc3")
+			_, message = client.cmd("XCRC file.txt")
+			So(message, ShouldEqual, "0d4a1185")
+		})
+
+		Convey("Will get an error for a missing file", func() {
+			code, _ := client.cmd("HASH missing.txt")
+			So(code, ShouldEqual, 550)
+		})
+	})
+}
+
+// testSiteCommand is a SITE subcommand that echoes its parameter
+type testSiteCommand struct {
+	auth bool
+}
+
+func (cmd testSiteCommand) RequireParam() bool {
+	return false
+}
+
+func (cmd testSiteCommand) RequireAuth() bool {
+	return cmd.auth
+}
+
+func (cmd testSiteCommand) Syntax() string {
+	return "[<text>]"
+}
+
+func (cmd testSiteCommand) Execute(session FTPSession, param string) error {
+	return session.WriteMessage(200, session.User()+" "+param)
+}
+
+// testSiteDriver is a testDriver that provides its own SITE subcommands
+type testSiteDriver struct {
+	*testDriver
+}
+
+func (driver testSiteDriver) SiteCommands() map[string]FTPCommand {
+	return map[string]FTPCommand{"symlink": testSiteCommand{auth: true}}
+}
+
+func TestSite(t *testing.T) {
+	Convey("A logged in client", t, func() {
+		driver := newTestDriver()
+		driver.setFile("/script.sh", "#!/bin/sh")
+		client := newTestClient(t, testSiteDriver{driver}, &FTPServerOpts{
+			SiteCommands: map[string]FTPCommand{"Echo": testSiteCommand{}},
+		})
+		defer client.Close()
+
+		Convey("Will be able to change the mode of a file", func() {
+			client.login()
+			code, _ := client.cmd("SITE CHMOD 755 script.sh")
+			So(code, ShouldEqual, 200)
+			So(driver.mode("/script.sh"), ShouldEqual, os.FileMode(0755))
+		})
+
+		Convey("Will be able to set the setuid, setgid and sticky bits", func() {
+			client.login()
+			code, _ := client.cmd("SITE CHMOD 4755 script.sh")
+			So(code, ShouldEqual, 200)
+			So(driver.mode("/script.sh"), ShouldEqual, os.ModeSetuid|0755)
+			client.cmd("SITE CHMOD 3775 script.sh")
+			So(driver.mode("/script.sh"), ShouldEqual, os.ModeSetgid|os.ModeSticky|0775)
+		})
+
+		Convey("Will get an error for an invalid mode", func() {
+			client.login()
+			code, _ := client.cmd("SITE CHMOD 999 script.sh")
+			So(code, ShouldEqual, 501)
+		})
+
+		Convey("Will be able to use subcommands of the application", func() {
+			code, message := client.cmd("SITE ECHO hello")
+			So(code, ShouldEqual, 200)
+			So(message, ShouldEqual, " hello")
+		})
+
+		Convey("Will be able to use subcommands of the driver", func() {
+			code, _ := client.cmd("SITE SYMLINK a b")
+			So(code, ShouldEqual, 530)
+			client.login()
+			code, message := client.cmd("SITE SYMLINK a b")
+			So(code, ShouldEqual, 200)
+			So(message, ShouldEqual, "test a b")
+		})
+
+		Convey("Will get a list of the subcommands", func() {
+			code, message := client.cmd("SITE HELP")
+			So(code, ShouldEqual, 214)
+			So(message, ShouldContainSubstring, "CHMOD")
+			So(message, ShouldContainSubstring, "ECHO")
+			So(message, ShouldContainSubstring, "SYMLINK")
+			_, message = client.cmd("SITE HELP chmod")
+			So(message, ShouldEqual, "Syntax: SITE CHMOD <mode> <path>")
+		})
+
+		Convey("Will get an error for unknown subcommands", func() {
+			code, _ := client.cmd("SITE FOO")
+			So(code, ShouldEqual, 500)
+		})
+	})
+}
+
+// testListCommand replaces LIST with a listing of a fixed text
+type testListCommand struct{}
+
+func (cmd testListCommand) RequireParam() bool {
+	return false
+}
+
+func (cmd testListCommand) RequireAuth() bool {
+	return true
+}
+
+func (cmd testListCommand) Syntax() string {
+	return "[<path>]"
+}
+
+func (cmd testListCommand) Execute(session FTPSession, param string) error {
+	if !session.HasDataConnection() {
+		return session.WriteMessage(425, "Can't open data connection.")
+	}
+	if err := session.WriteMessage(150, "Here comes the listing"); err != nil {
+		return err
+	}
+	session.SendData(session.BuildPath(param), strings.NewReader("custom listing"))
+	return nil
+}
+
+// testUploadCommand stores uploads in received
+type testUploadCommand struct {
+	received chan string
+}
+
+func (cmd testUploadCommand) RequireParam() bool {
+	return false
+}
+
+func (cmd testUploadCommand) RequireAuth() bool {
+	return true
+}
+
+func (cmd testUploadCommand) Syntax() string {
+	return ""
+}
+
+func (cmd testUploadCommand) Execute(session FTPSession, param string) error {
+	if !session.HasDataConnection() {
+		return session.WriteMessage(425, "Can't open data connection.")
+	}
+	if err := session.WriteMessage(150, "Send the data"); err != nil {
+		return err
+	}
+	session.ReceiveData("", func(reader io.Reader) error {
+		data, err := ioutil.ReadAll(reader)
+		cmd.received <- string(data)
+		return err
+	})
+	return nil
+}
+
+func TestCustomCommands(t *testing.T) {
+	Convey("A client of a server with custom commands", t, func() {
+		received := make(chan string, 1)
+		client := newTestClient(t, newTestDriver(), &FTPServerOpts{
+			Commands: map[string]FTPCommand{
+				"LIST":    testListCommand{},
+				"xupload": testUploadCommand{received: received},
+				"SITE":    nil,
+			},
+		})
+		defer client.Close()
+		client.login()
+
+		Convey("Will get the reply of a replaced command", func() {
+			dataConn := client.pasv()
+			code, _ := client.cmd("LIST")
+			So(code, ShouldEqual, 150)
+			data, _ := ioutil.ReadAll(dataConn)
+			So(string(data), ShouldEqual, "custom listing")
+			client.expect(226)
+		})
+
+		Convey("Will be able to tell that there is no data connection", func() {
+			code, _ := client.cmd("LIST")
+			So(code, ShouldEqual, 425)
+			code, _ = client.cmd("XUPLOAD")
+			So(code, ShouldEqual, 425)
+			code, _ = client.cmd("NOOP")
+			So(code, ShouldEqual, 200)
+		})
+
+		Convey("Will be able to use an added command", func() {
+			dataConn := client.pasv()
+			code, _ := client.cmd("XUPLOAD")
+			So(code, ShouldEqual, 150)
+			dataConn.Write([]byte("uploaded"))
+			dataConn.Close()
+			client.expect(226)
+			So(<-received, ShouldEqual, "uploaded")
+		})
+
+		Convey("Will not be able to use a removed command", func() {
+			code, _ := client.cmd("SITE HELP")
+			So(code, ShouldEqual, 500)
+		})
+
+		Convey("Will see the commands in HELP", func() {
+			_, message := client.cmd("HELP")
+			So(message, ShouldContainSubstring, "XUPLOAD")
+			So(message, ShouldNotContainSubstring, "SITE")
+		})
+	})
+
+	Convey("A client of another server", t, func() {
+		client := newTestClient(t, newTestDriver(), nil)
+		defer client.Close()
+		client.login()
+
+		Convey("Will not see the custom commands", func() {
+			code, _ := client.cmd("XUPLOAD")
+			So(code, ShouldEqual, 500)
+		})
+	})
+}
+
+// testSilentCommand fails without replying
+type testSilentCommand struct{}
+
+func (cmd testSilentCommand) RequireParam() bool {
+	return false
+}
+
+func (cmd testSilentCommand) RequireAuth() bool {
+	return false
+}
+
+func (cmd testSilentCommand) Syntax() string {
+	return ""
+}
+
+func (cmd testSilentCommand) Execute(session FTPSession, param string) error {
+	return errors.New("failed silently")
+}
+
+func TestInterceptors(t *testing.T) {
+	Convey("A client of a server with interceptors", t, func() {
+		var mu sync.Mutex
+		var audit []string
+		auditor := func(session FTPSession, verb string, param string, next func() error) error {
+			err := next()
+			mu.Lock()
+			defer mu.Unlock()
+			audit = append(audit, verb+" "+strconv.Itoa(session.LastReplyCode()))
+			return err
+		}
+		maintenance := func(session FTPSession, verb string, param string, next func() error) error {
+			if verb == "STOR" || verb == "DELE" {
+				return session.WriteMessage(450, "Server is in maintenance mode")
+			}
+			return next()
+		}
+
+		driver := newTestDriver()
+		driver.setFile("/keep.txt", "keep")
+		client := newTestClient(t, driver, &FTPServerOpts{
+			Interceptors: []FTPInterceptor{auditor, maintenance},
+			Commands:     map[string]FTPCommand{"XSILENT": testSilentCommand{}},
+		})
+		defer client.Close()
+		client.login()
+
+		Convey("Will be able to use commands that are let through", func() {
+			code, _ := client.cmd("PWD")
+			So(code, ShouldEqual, 257)
+		})
+
+		Convey("Will get the reply of an interceptor that vetoes a command", func() {
+			code, message := client.cmd("DELE keep.txt")
+			So(code, ShouldEqual, 450)
+			So(message, ShouldEqual, "Server is in maintenance mode")
+			_, exists := driver.file("/keep.txt")
+			So(exists, ShouldBeTrue)
+		})
+
+		Convey("Will have its commands and replies audited", func() {
+			client.cmd("PWD")
+			client.cmd("DELE keep.txt")
+			client.cmd("FOO")
+			// the audit entry of a command is added after its reply was sent,
+			// the reply to NOOP means the entry of FOO is there
+			client.cmd("NOOP")
+			mu.Lock()
+			defer mu.Unlock()
+			So(audit[:5], ShouldResemble, []string{"USER 331", "PASS 230", "PWD 257", "DELE 450", "FOO 500"})
+		})
+
+		Convey("Will have only the replies of the command itself audited", func() {
+			client.PrintfLine("XSILENT")
+			dataConn := client.pasv()
+			client.cmd("RETR keep.txt")
+			ioutil.ReadAll(dataConn)
+			client.expect(226)
+			client.cmd("NOOP")
+			client.cmd("NOOP")
+			mu.Lock()
+			defer mu.Unlock()
+			So(audit[2:6], ShouldResemble, []string{"XSILENT 0", "EPSV 229", "RETR 150", "NOOP 200"})
+		})
+	})
+}
+
+// testNotifier records events and lets tests wait for them
+type testNotifier struct {
+	events chan FTPEvent
+}
+
+func newTestNotifier() *testNotifier {
+	return &testNotifier{events: make(chan FTPEvent, 100)}
+}
+
+func (notifier *testNotifier) Notify(event FTPEvent) {
+	notifier.events <- event
+}
+
+// next returns the next event, or an event without a type if none arrived in
+// time
+func (notifier *testNotifier) next() FTPEvent {
+	select {
+	case event := <-notifier.events:
+		return event
+	case <-time.After(2 * time.Second):
+		return FTPEvent{}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	Convey("A client of a server with a notifier", t, func() {
+		notifier := newTestNotifier()
+		driver := newTestDriver()
+		driver.setFile("/download.txt", "some content")
+		client := newTestClient(t, driver, &FTPServerOpts{Notifier: notifier, LoginFailureDelay: time.Millisecond})
+		defer client.Close()
+
+		event := notifier.next()
+		So(event.Type, ShouldEqual, EventConnected)
+		So(event.RemoteIP, ShouldEqual, "127.0.0.1")
+		So(event.SessionID, ShouldNotBeBlank)
+
+		Convey("Will notify about logins", func() {
+			client.cmd("USER test")
+			client.cmd("PASS wrong")
+			event := notifier.next()
+			So(event.Type, ShouldEqual, EventLoginFailed)
+			So(event.User, ShouldEqual, "test")
+
+			client.login()
+			event = notifier.next()
+			So(event.Type, ShouldEqual, EventLoginSucceeded)
+			So(event.User, ShouldEqual, "test")
+		})
+
+		Convey("Will notify about refused logins", func() {
+			filter, _ := NewFTPIPFilter([]string{"192.0.2.0/24"}, nil)
+			driver.userOpts = &FTPUserOpts{IPFilter: filter}
+			client.cmd("USER test")
+			client.cmd("PASS secret")
+			event := notifier.next()
+			So(event.Type, ShouldEqual, EventLoginFailed)
+			So(event.User, ShouldEqual, "test")
+			So(event.Err, ShouldEqual, ErrLoginNotAllowed)
+		})
+
+		Convey("Will notify about transfers", func() {
+			client.login()
+			notifier.next()
+
+			dataConn := client.pasv()
+			client.cmd("STOR upload.txt")
+			So(notifier.next().Type, ShouldEqual, EventUploadStarted)
+			dataConn.Write([]byte("hello world"))
+			dataConn.Close()
+			client.expect(226)
+			event := notifier.next()
+			So(event.Type, ShouldEqual, EventUploadCompleted)
+			So(event.Path, ShouldEqual, "/upload.txt")
+			So(event.Bytes, ShouldEqual, 11)
+
+			dataConn = client.pasv()
+			client.cmd("RETR download.txt")
+			ioutil.ReadAll(dataConn)
+			client.expect(226)
+			event = notifier.next()
+			So(event.Type, ShouldEqual, EventDownloadCompleted)
+			So(event.Path, ShouldEqual, "/download.txt")
+			So(event.Bytes, ShouldEqual, 12)
+		})
+
+		Convey("Will notify about file operations", func() {
+			client.login()
+			notifier.next()
+
+			client.cmd("MKD docs")
+			event := notifier.next()
+			So(event.Type, ShouldEqual, EventDirCreated)
+			So(event.Path, ShouldEqual, "/docs")
+
+			client.cmd("RNFR download.txt")
+			client.cmd("RNTO docs/renamed.txt")
+			event = notifier.next()
+			So(event.Type, ShouldEqual, EventRenamed)
+			So(event.FromPath, ShouldEqual, "/download.txt")
+			So(event.Path, ShouldEqual, "/docs/renamed.txt")
+
+			client.cmd("DELE docs/renamed.txt")
+			So(notifier.next().Type, ShouldEqual, EventDeleted)
+			client.cmd("RMD docs")
+			So(notifier.next().Type, ShouldEqual, EventDirRemoved)
+		})
+
+		Convey("Will notify about the disconnect", func() {
+			client.login()
+			notifier.next()
+			client.cmd("QUIT")
+			event := notifier.next()
+			So(event.Type, ShouldEqual, EventDisconnected)
+			So(event.User, ShouldEqual, "test")
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package graval
+
+import (
+	"sync"
+)
+
+// FTPServerStats is a snapshot of the connection counters of an FTPServer,
+// returned by FTPServer.Stats() for monitoring.
+type FTPServerStats struct {
+	// The number of currently open client connections
+	Connections int
+
+	// The number of currently open client connections by remote IP address
+	ConnectionsPerIP map[string]int
+
+	// The number of currently logged in sessions by username
+	SessionsPerUser map[string]int
+
+	// The number of client connections accepted since the server started
+	AcceptedConnections uint64
+
+	// The number of client connections and logins refused because a limit
+	// was reached since the server started
+	RejectedConnections uint64
+}
+
+// connCounter keeps track of open connections and logged in sessions, so the
+// server can enforce its connection limits. A limit of 0 means unlimited.
+type connCounter struct {
+	mu       sync.Mutex
+	total    int
+	perIP    map[string]int
+	perUser  map[string]int
+	accepted uint64
+	rejected uint64
+}
+
+func newConnCounter() *connCounter {
+	c := new(connCounter)
+	c.perIP = make(map[string]int)
+	c.perUser = make(map[string]int)
+	return c
+}
+
+// acquireConn counts a new connection from ip, unless that would exceed
+// maxTotal or maxPerIP. It returns false if the connection must be refused.
+func (c *connCounter) acquireConn(ip string, maxTotal int, maxPerIP int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if (maxTotal > 0 && c.total >= maxTotal) || (maxPerIP > 0 && c.perIP[ip] >= maxPerIP) {
+		c.rejected++
+		return false
+	}
+	c.total++
+	c.perIP[ip]++
+	c.accepted++
+	return true
+}
+
+// releaseConn forgets a connection counted by acquireConn
+func (c *connCounter) releaseConn(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total--
+	if c.perIP[ip]--; c.perIP[ip] <= 0 {
+		delete(c.perIP, ip)
+	}
+}
+
+// acquireUser counts a new session for user, unless that would exceed max.
+// It returns false if the login must be refused.
+func (c *connCounter) acquireUser(user string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.perUser[user] >= max {
+		c.rejected++
+		return false
+	}
+	c.perUser[user]++
+	return true
+}
+
+// releaseUser forgets a session counted by acquireUser
+func (c *connCounter) releaseUser(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perUser[user]--; c.perUser[user] <= 0 {
+		delete(c.perUser, user)
+	}
+}
+
+func (c *connCounter) stats() FTPServerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := FTPServerStats{
+		Connections:         c.total,
+		ConnectionsPerIP:    make(map[string]int, len(c.perIP)),
+		SessionsPerUser:     make(map[string]int, len(c.perUser)),
+		AcceptedConnections: c.accepted,
+		RejectedConnections: c.rejected,
+	}
+	for ip, count := range c.perIP {
+		stats.ConnectionsPerIP[ip] = count
+	}
+	for user, count := range c.perUser {
+		stats.SessionsPerUser[user] = count
+	}
+	return stats
+}
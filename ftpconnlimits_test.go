@@ -0,0 +1,56 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestConnCounter(t *testing.T) {
+	Convey("The connection counter", t, func() {
+		counter := newConnCounter()
+
+		Convey("Will enforce the total limit", func() {
+			So(counter.acquireConn("10.0.0.1", 2, 0), ShouldBeTrue)
+			So(counter.acquireConn("10.0.0.2", 2, 0), ShouldBeTrue)
+			So(counter.acquireConn("10.0.0.3", 2, 0), ShouldBeFalse)
+			counter.releaseConn("10.0.0.1")
+			So(counter.acquireConn("10.0.0.3", 2, 0), ShouldBeTrue)
+		})
+
+		Convey("Will enforce the per IP limit", func() {
+			So(counter.acquireConn("10.0.0.1", 0, 1), ShouldBeTrue)
+			So(counter.acquireConn("10.0.0.1", 0, 1), ShouldBeFalse)
+			So(counter.acquireConn("10.0.0.2", 0, 1), ShouldBeTrue)
+		})
+
+		Convey("Will enforce the per user limit", func() {
+			So(counter.acquireUser("bob", 1), ShouldBeTrue)
+			So(counter.acquireUser("bob", 1), ShouldBeFalse)
+			So(counter.acquireUser("alice", 1), ShouldBeTrue)
+			counter.releaseUser("bob")
+			So(counter.acquireUser("bob", 1), ShouldBeTrue)
+		})
+
+		Convey("Will not limit anything by default", func() {
+			for i := 0; i < 10; i++ {
+				So(counter.acquireConn("10.0.0.1", 0, 0), ShouldBeTrue)
+				So(counter.acquireUser("bob", 0), ShouldBeTrue)
+			}
+		})
+
+		Convey("Will report its counters", func() {
+			counter.acquireConn("10.0.0.1", 0, 1)
+			counter.acquireConn("10.0.0.1", 0, 1)
+			counter.acquireConn("10.0.0.2", 0, 1)
+			counter.acquireUser("bob", 0)
+			counter.releaseConn("10.0.0.2")
+
+			stats := counter.stats()
+			So(stats.Connections, ShouldEqual, 1)
+			So(stats.ConnectionsPerIP, ShouldResemble, map[string]int{"10.0.0.1": 1})
+			So(stats.SessionsPerUser, ShouldResemble, map[string]int{"bob": 1})
+			So(stats.AcceptedConnections, ShouldEqual, 2)
+			So(stats.RejectedConnections, ShouldEqual, 1)
+		})
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -26,32 +27,32 @@ type ftpDataSocket interface {
 }
 
 type ftpActiveSocket struct {
-	conn   *net.TCPConn
-	host   string
-	port   uint16
-	logger FTPLogger
+	conn    *net.TCPConn
+	host    string
+	port    uint16
+	timeout time.Duration
+	logger  FTPLogger
 }
 
-func newActiveSocket(host string, port uint16, logger FTPLogger) (*ftpActiveSocket, error) {
+// newActiveSocket connects to a client that is listening for a data
+// connection. connectTimeout bounds how long connecting may take and
+// transferTimeout how long a single read or write may block, 0 disables them.
+func newActiveSocket(host string, port uint16, connectTimeout time.Duration, transferTimeout time.Duration, logger FTPLogger) (*ftpActiveSocket, error) {
 	connectTo := buildTcpString(host, port)
 	if logger != nil {
 		logger.Debug("Opening active data connection to ", connectTo)
 	}
 
-	remoteAddress, err := net.ResolveTCPAddr("tcp", connectTo)
-	if err != nil {
-		return nil, err
-	}
-
-	tcpConn, err := net.DialTCP("tcp", nil, remoteAddress)
+	conn, err := net.DialTimeout("tcp", connectTo, connectTimeout)
 	if err != nil {
 		return nil, err
 	}
 
 	socket := new(ftpActiveSocket)
-	socket.conn = tcpConn
+	socket.conn = conn.(*net.TCPConn)
 	socket.host = host
 	socket.port = port
+	socket.timeout = transferTimeout
 	socket.logger = logger
 	return socket, nil
 }
@@ -65,10 +66,16 @@ func (socket *ftpActiveSocket) Port() uint16 {
 }
 
 func (socket *ftpActiveSocket) Read(p []byte) (n int, err error) {
+	if err := setTransferDeadline(socket.conn, socket.timeout); err != nil {
+		return 0, err
+	}
 	return socket.conn.Read(p)
 }
 
 func (socket *ftpActiveSocket) Write(p []byte) (n int, err error) {
+	if err := setTransferDeadline(socket.conn, socket.timeout); err != nil {
+		return 0, err
+	}
 	return socket.conn.Write(p)
 }
 
@@ -78,22 +85,34 @@ func (socket *ftpActiveSocket) Close() error {
 
 type ftpPassiveSocket struct {
 	conn     *net.TCPConn
+	listener *net.TCPListener
 	port     uint16
 	listenIP string
+	timeout  time.Duration
 	logger   FTPLogger
+	mu       sync.Mutex
+	closed   bool
+	ready    chan struct{}
 }
 
-func newPassiveSocket(listenIP string, minPort uint16, maxPort uint16, logger FTPLogger) (*ftpPassiveSocket, error) {
+// newPassiveSocket starts listening for a data connection from the client.
+// The client has acceptTimeout to connect, after which the listener is
+// closed. transferTimeout bounds how long a single read or write may block.
+// A timeout of 0 disables it.
+func newPassiveSocket(listenIP string, minPort uint16, maxPort uint16, acceptTimeout time.Duration, transferTimeout time.Duration, logger FTPLogger) (*ftpPassiveSocket, error) {
 	socket := new(ftpPassiveSocket)
 	socket.logger = logger
 	socket.listenIP = listenIP
-	go socket.ListenAndServe(minPort, maxPort)
-	for {
-		if socket.Port() > 0 {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
+	socket.timeout = transferTimeout
+	socket.ready = make(chan struct{})
+
+	listener, err := socket.netListenerInRange(minPort, maxPort)
+	if err != nil {
+		return nil, err
 	}
+	socket.listener = listener
+	socket.port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	go socket.ListenAndServe(acceptTimeout)
 	return socket, nil
 }
 
@@ -106,65 +125,78 @@ func (socket *ftpPassiveSocket) Port() uint16 {
 }
 
 func (socket *ftpPassiveSocket) Read(p []byte) (n int, err error) {
-	if socket.waitForOpenSocket() == false {
+	conn := socket.waitForOpenSocket()
+	if conn == nil {
 		return 0, errors.New("data socket unavailable")
 	}
-	return socket.conn.Read(p)
+	if err := setTransferDeadline(conn, socket.timeout); err != nil {
+		return 0, err
+	}
+	return conn.Read(p)
 }
 
 func (socket *ftpPassiveSocket) Write(p []byte) (n int, err error) {
-	if socket.waitForOpenSocket() == false {
+	conn := socket.waitForOpenSocket()
+	if conn == nil {
 		return 0, errors.New("data socket unavailable")
 	}
-	return socket.conn.Write(p)
+	if err := setTransferDeadline(conn, socket.timeout); err != nil {
+		return 0, err
+	}
+	return conn.Write(p)
 }
 
 func (socket *ftpPassiveSocket) Close() error {
 	if socket.logger != nil {
 		socket.logger.Debug("closing passive data socket")
 	}
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	socket.closed = true
+	// closing the listener unblocks ListenAndServe if nobody connected yet
+	socket.listener.Close()
 	if socket.conn != nil {
 		return socket.conn.Close()
 	}
 	return nil
 }
 
-func (socket *ftpPassiveSocket) ListenAndServe(minPort, maxPort uint16) error {
-	listener, err := socket.netListenerInRange(minPort, maxPort)
-	if err != nil {
-		return err
-	}
-	defer listener.Close()
+// ListenAndServe waits for the client to connect to the listener. It gives up
+// once timeout has passed or the socket is closed.
+func (socket *ftpPassiveSocket) ListenAndServe(timeout time.Duration) error {
+	defer close(socket.ready)
+	defer socket.listener.Close()
 
-	add := listener.Addr().(*net.TCPAddr)
-	socket.port = uint16(add.Port)
+	if timeout > 0 {
+		if err := socket.listener.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
 
-	tcpConn, err := listener.AcceptTCP()
+	tcpConn, err := socket.listener.AcceptTCP()
 	if err != nil {
+		if socket.logger != nil {
+			socket.logger.Debugf("passive data socket not connected %v", err)
+		}
 		return err
 	}
 
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	if socket.closed {
+		return tcpConn.Close()
+	}
 	socket.conn = tcpConn
 	return nil
 }
 
-func (socket *ftpPassiveSocket) waitForOpenSocket() bool {
-	retries := 0
-	for {
-		if socket.conn != nil {
-			break
-		}
-		if retries > 3 {
-			return false
-		}
-		if socket.logger != nil {
-			socket.logger.Debug("sleeping, socket isn't open")
-		}
-		duration := time.Duration(500*(retries+1)) * time.Millisecond
-		time.Sleep(duration)
-		retries += 1
-	}
-	return true
+// waitForOpenSocket blocks until the client connected or gave up, and returns
+// the data connection or nil.
+func (socket *ftpPassiveSocket) waitForOpenSocket() *net.TCPConn {
+	<-socket.ready
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	return socket.conn
 }
 
 func (socket *ftpPassiveSocket) netListenerInRange(min, max uint16) (*net.TCPListener, error) {
@@ -178,6 +210,15 @@ func (socket *ftpPassiveSocket) netListenerInRange(min, max uint16) (*net.TCPLis
 	return nil, errors.New("unable to find available port to listen on")
 }
 
+// setTransferDeadline bounds how long the next read or write on conn may
+// block, a timeout of 0 disables the deadline.
+func setTransferDeadline(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	return conn.SetDeadline(time.Now().Add(timeout))
+}
+
 func randomPort(min, max uint16) uint16 {
 	if min == 0 && max == 0 {
 		return 0
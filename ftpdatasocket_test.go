@@ -0,0 +1,38 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPassiveSocketTimeout(t *testing.T) {
+	Convey("A passive socket nobody connects to", t, func() {
+		socket, err := newPassiveSocket("127.0.0.1", 0, 0, 100*time.Millisecond, 0, nil)
+		So(err, ShouldBeNil)
+		defer socket.Close()
+
+		Convey("Will stop listening once the timeout passed", func() {
+			_, err := socket.Write([]byte("data"))
+			So(err, ShouldNotBeNil)
+			_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(socket.Port()))))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("A passive socket that is closed before anybody connects", t, func() {
+		socket, err := newPassiveSocket("127.0.0.1", 0, 0, time.Minute, 0, nil)
+		So(err, ShouldBeNil)
+
+		Convey("Will stop listening immediately", func() {
+			So(socket.Close(), ShouldBeNil)
+			select {
+			case <-socket.ready:
+			case <-time.After(time.Second):
+				t.Fatal("passive socket is still listening")
+			}
+		})
+	})
+}
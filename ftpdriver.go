@@ -1,11 +1,17 @@
 package graval
 
 import (
+	"errors"
 	"io"
 	"os"
 	"time"
 )
 
+// ErrUploadTooLarge is returned by the reader handed to FTPDriver.PutFile when
+// the upload exceeds the maximum upload size. Drivers should discard the
+// partial file when they see it.
+var ErrUploadTooLarge = errors.New("maximum upload size exceeded")
+
 // For each client that connects to the server, a new FTPDriver is required.
 // Create an implementation if this interface and provide it to FTPServer.
 type FTPDriverFactory interface {
@@ -65,3 +71,48 @@ type FTPDriver interface {
 	// returns - true if the data was successfully persisted
 	PutFile(string, io.Reader) (bool, error)
 }
+
+// FTPUploadAbortDriver is an optional interface that an FTPDriver can
+// implement to learn about uploads the server aborted, for example because
+// they exceeded the quota or the maximum upload size. It is called after
+// PutFile returned, so the driver can discard any partial data it stored.
+type FTPUploadAbortDriver interface {
+	// params  - destination path, the reason the upload was aborted
+	// returns - an error if the partial data couldn't be discarded
+	AbortUpload(string, error) error
+}
+
+// FTPModifiedTimeDriver is an optional interface that an FTPDriver can
+// implement to let clients set the modification time of files with MFMT or
+// MDTM, which sync tools use to preserve timestamps.
+type FTPModifiedTimeDriver interface {
+	// params  - path, the new modification time
+	// returns - an error if the time couldn't be set
+	SetModifiedTime(string, time.Time) error
+}
+
+// FTPCreationTimeDriver is an optional interface that an FTPDriver can
+// implement to let clients set the creation time of files with MFCT.
+type FTPCreationTimeDriver interface {
+	// params  - path, the new creation time
+	// returns - an error if the time couldn't be set
+	SetCreationTime(string, time.Time) error
+}
+
+// FTPHashDriver is an optional interface that an FTPDriver can implement when
+// its backend stores checksums, so HASH and the XCRC, XMD5 and XSHA commands
+// don't have to read the whole file to compute them.
+type FTPHashDriver interface {
+	// params  - path, an algorithm like "SHA-256", "SHA-1", "MD5" or "CRC32"
+	// returns - the hash of the whole file as hex, or an empty string if it
+	//           isn't known and should be computed from the file
+	Hash(string, string) (string, error)
+}
+
+// FTPChmodDriver is an optional interface that an FTPDriver can implement to
+// let clients change the mode of files and directories with SITE CHMOD.
+type FTPChmodDriver interface {
+	// params  - path, the new mode
+	// returns - an error if the mode couldn't be changed
+	Chmod(string, os.FileMode) error
+}
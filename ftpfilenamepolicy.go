@@ -0,0 +1,129 @@
+package graval
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// FTPFilenamePolicy restricts the names of the files and directories clients
+// create. graval checks it for uploads, new directories and rename targets,
+// and rejects names that break it with a 553 reply.
+type FTPFilenamePolicy struct {
+	// Glob patterns, in the syntax of path.Match, for names that may be
+	// created. They are matched case-insensitively against the last
+	// component of the path. Optional, an empty list allows all names.
+	Allow []string
+
+	// Glob patterns for names that may not be created, like "*.exe". They win
+	// over the Allow patterns. Optional.
+	Deny []string
+
+	// The maximum length of the full path in bytes. Optional, defaults to 0
+	// which means unlimited.
+	MaxPathLength int
+
+	// The maximum length of a name in bytes. Optional, defaults to 0 which
+	// means unlimited.
+	MaxComponentLength int
+
+	// Rejects names that contain control characters
+	DenyControlChars bool
+
+	// Rejects names that end in a dot or a space, which Windows silently
+	// strips
+	DenyTrailingDots bool
+
+	// Rejects names that are reserved on Windows, like CON, NUL or LPT1, with
+	// or without an extension
+	DenyReservedNames bool
+}
+
+// DefaultFTPFilenamePolicy returns a policy that rejects names which cause
+// trouble on common filesystems, and allows everything else.
+func DefaultFTPFilenamePolicy() *FTPFilenamePolicy {
+	return &FTPFilenamePolicy{
+		MaxPathLength:      4096,
+		MaxComponentLength: 255,
+		DenyControlChars:   true,
+		DenyTrailingDots:   true,
+		DenyReservedNames:  true,
+	}
+}
+
+var reservedWindowsNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Check returns an error describing why the policy doesn't allow creating
+// filePath, or nil if it does. A nil FTPFilenamePolicy allows everything.
+//
+// The Allow and Deny patterns apply to the last component of the path, all
+// other rules to every component, since drivers may create the missing
+// parent directories.
+func (policy *FTPFilenamePolicy) Check(filePath string) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.MaxPathLength > 0 && len(filePath) > policy.MaxPathLength {
+		return fmt.Errorf("path is longer than %d bytes", policy.MaxPathLength)
+	}
+
+	cleanPath := path.Clean("/" + filePath)
+	for _, name := range strings.Split(strings.TrimPrefix(cleanPath, "/"), "/") {
+		if err := policy.checkName(name); err != nil {
+			return err
+		}
+	}
+
+	name := path.Base(cleanPath)
+	lowerName := strings.ToLower(name)
+	if matchesAnyPattern(policy.Deny, lowerName) {
+		return fmt.Errorf("name %s is not allowed", name)
+	}
+	if len(policy.Allow) > 0 && !matchesAnyPattern(policy.Allow, lowerName) {
+		return fmt.Errorf("name %s is not allowed", name)
+	}
+	return nil
+}
+
+// checkName applies the rules of the policy that don't depend on patterns
+// to a single component of a path
+func (policy *FTPFilenamePolicy) checkName(name string) error {
+	if policy.MaxComponentLength > 0 && len(name) > policy.MaxComponentLength {
+		return fmt.Errorf("name is longer than %d bytes", policy.MaxComponentLength)
+	}
+
+	if policy.DenyControlChars && strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("name contains control characters")
+	}
+
+	if policy.DenyTrailingDots && (strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ")) {
+		return fmt.Errorf("name ends with a dot or a space")
+	}
+
+	if policy.DenyReservedNames {
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if reservedWindowsNames[strings.TrimRight(base, " ")] {
+			return fmt.Errorf("%s is a reserved name", name)
+		}
+	}
+	return nil
+}
+
+// matchesAnyPattern returns true if name matches one of the glob patterns.
+// Patterns are compared in lower case, malformed patterns never match.
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
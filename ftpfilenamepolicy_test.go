@@ -0,0 +1,74 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestFilenamePolicy(t *testing.T) {
+	Convey("The default filename policy", t, func() {
+		policy := DefaultFTPFilenamePolicy()
+
+		Convey("Will allow ordinary names", func() {
+			So(policy.Check("/files/report 2020.pdf"), ShouldBeNil)
+			So(policy.Check("/files/.hidden"), ShouldBeNil)
+		})
+
+		Convey("Will reject control characters", func() {
+			So(policy.Check("/files/bad\x07name"), ShouldNotBeNil)
+		})
+
+		Convey("Will reject trailing dots and spaces", func() {
+			So(policy.Check("/files/name."), ShouldNotBeNil)
+			So(policy.Check("/files/name "), ShouldNotBeNil)
+		})
+
+		Convey("Will reject reserved Windows names", func() {
+			So(policy.Check("/files/CON"), ShouldNotBeNil)
+			So(policy.Check("/files/nul.txt"), ShouldNotBeNil)
+			So(policy.Check("/files/lpt1.tar.gz"), ShouldNotBeNil)
+			So(policy.Check("/files/console"), ShouldBeNil)
+		})
+
+		Convey("Will reject overly long names", func() {
+			So(policy.Check("/files/"+strings.Repeat("a", 256)), ShouldNotBeNil)
+			So(policy.Check(strings.Repeat("/abc", 1100)), ShouldNotBeNil)
+		})
+
+		Convey("Will check every component of the path", func() {
+			So(policy.Check("/a/bad\x07dir/c"), ShouldNotBeNil)
+			So(policy.Check("/"+strings.Repeat("a", 256)+"/file.txt"), ShouldNotBeNil)
+			So(policy.Check("/files./file.txt"), ShouldNotBeNil)
+			So(policy.Check("/aux/file.txt"), ShouldNotBeNil)
+		})
+	})
+
+	Convey("A filename policy with patterns", t, func() {
+		policy := &FTPFilenamePolicy{
+			Allow: []string{"*.csv", "*.txt", "*.exe"},
+			Deny:  []string{"*.EXE"},
+		}
+
+		Convey("Will only allow matching names", func() {
+			So(policy.Check("/data.CSV"), ShouldBeNil)
+			So(policy.Check("/notes.txt"), ShouldBeNil)
+			So(policy.Check("/image.png"), ShouldNotBeNil)
+		})
+
+		Convey("Will let deny patterns win", func() {
+			So(policy.Check("/setup.exe"), ShouldNotBeNil)
+		})
+
+		Convey("Will only match the last component", func() {
+			So(policy.Check("/uploads/data.csv"), ShouldBeNil)
+		})
+	})
+
+	Convey("A nil filename policy", t, func() {
+		var policy *FTPFilenamePolicy
+		Convey("Will allow everything", func() {
+			So(policy.Check("/CON."), ShouldBeNil)
+		})
+	})
+}
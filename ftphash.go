@@ -0,0 +1,87 @@
+package graval
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// hashAlgorithms are the algorithms HASH supports, by their names in
+// draft-bryan-ftpext-hash
+var hashAlgorithms = map[string]func() hash.Hash{
+	"CRC32":   func() hash.Hash { return crc32.NewIEEE() },
+	"MD5":     md5.New,
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// the order in which FEAT lists the algorithms
+var hashAlgorithmNames = []string{"SHA-1", "SHA-256", "SHA-512", "MD5", "CRC32"}
+
+const defaultHashAlgorithm = "SHA-256"
+
+// ftpHashRange limits the next HASH to the bytes from start up to, but not
+// including, end. It is set with RANG.
+type ftpHashRange struct {
+	start int64
+	end   int64
+}
+
+// hashFeature returns the HASH line for FEAT, which marks the selected
+// algorithm with a star
+func hashFeature(selected string) string {
+	names := make([]string, len(hashAlgorithmNames))
+	for i, name := range hashAlgorithmNames {
+		names[i] = name
+		if name == selected {
+			names[i] += "*"
+		}
+	}
+	return "HASH " + strings.Join(names, ";")
+}
+
+// fileHash returns the hash of the bytes from start up to end of the file at
+// filePath, as lower case hex. Drivers that implement FTPHashDriver are
+// asked first when the whole file is hashed, size is the size of the file.
+func fileHash(driver FTPDriver, filePath string, algorithm string, start int64, end int64, size int64) (string, error) {
+	if hashDriver, ok := driver.(FTPHashDriver); ok && start == 0 && end >= size {
+		sum, err := hashDriver.Hash(filePath, algorithm)
+		if err != nil {
+			return "", err
+		}
+		if sum != "" {
+			return strings.ToLower(sum), nil
+		}
+	}
+
+	reader, err := driver.GetFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	if start > 0 {
+		if seeker, ok := reader.(io.Seeker); ok {
+			_, err = seeker.Seek(start, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, reader, start)
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+	}
+
+	hasher := hashAlgorithms[algorithm]()
+	if _, err := io.CopyN(hasher, reader, end-start); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
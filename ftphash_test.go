@@ -0,0 +1,38 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestFileHash(t *testing.T) {
+	driver := newTestDriver()
+	driver.files["/file.txt"] = []byte("hello world")
+
+	Convey("Hashing a file", t, func() {
+		Convey("Will hash the whole file", func() {
+			sum, err := fileHash(driver, "/file.txt", "SHA-256", 0, 11, 11)
+			So(err, ShouldBeNil)
+			So(sum, ShouldEqual, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9")
+		})
+
+		Convey("Will hash a range of the file", func() {
+			sum, err := fileHash(driver, "/file.txt", "MD5", 6, 11, 11)
+			So(err, ShouldBeNil)
+			// md5 of "world"
+			So(sum, ShouldEqual, "7d793037a0760186574b0282f2f435e7")
+		})
+
+		Convey("Will support CRC32", func() {
+			sum, err := fileHash(driver, "/file.txt", "CRC32", 0, 11, 11)
+			So(err, ShouldBeNil)
+			So(sum, ShouldEqual, "0d4a1185")
+		})
+	})
+
+	Convey("The HASH feature", t, func() {
+		Convey("Will mark the selected algorithm", func() {
+			So(hashFeature("SHA-256"), ShouldEqual, "HASH SHA-1;SHA-256*;SHA-512;MD5;CRC32")
+		})
+	})
+}
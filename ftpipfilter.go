@@ -0,0 +1,104 @@
+package graval
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// FTPIPFilter decides which remote addresses are allowed to connect, based on
+// lists of allowed and denied networks. Both IPv4 and IPv6 are supported.
+//
+// An address that matches the deny list is always rejected. When the allow
+// list is empty every other address is allowed, otherwise the address must
+// match the allow list as well.
+//
+// Always use the NewFTPIPFilter() function to create a new FTPIPFilter.
+type FTPIPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// FTPIPFilterProvider supplies the FTPIPFilter that is applied to a client.
+// It is consulted every time a filter is needed, so implementations can
+// return a different filter when their lists change at runtime. A nil filter
+// allows every address.
+//
+// FTPIPFilter implements this interface itself for lists that never change.
+type FTPIPFilterProvider interface {
+	IPFilter() *FTPIPFilter
+}
+
+// NewFTPIPFilter builds a filter from lists of networks in CIDR notation, like
+// "10.0.0.0/8" or "2001:db8::/32". Single addresses without a prefix length
+// are accepted too. An error is returned if any entry can't be parsed.
+func NewFTPIPFilter(allow []string, deny []string) (*FTPIPFilter, error) {
+	filter := new(FTPIPFilter)
+	var err error
+	if filter.allow, err = parseIPNets(allow); err != nil {
+		return nil, err
+	}
+	if filter.deny, err = parseIPNets(deny); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// IPFilter returns the filter itself, so it can be used as a provider
+func (filter *FTPIPFilter) IPFilter() *FTPIPFilter {
+	return filter
+}
+
+// Allowed returns true if a client connecting from ip is allowed
+func (filter *FTPIPFilter) Allowed(ip net.IP) bool {
+	if filter == nil {
+		return true
+	}
+	if containsIP(filter.deny, ip) {
+		return false
+	}
+	return len(filter.allow) == 0 || containsIP(filter.allow, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseIPNets(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", entry)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				networks = append(networks, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s - %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ipAllowed returns true if the provider is nil or its filter allows ip
+func ipAllowed(provider FTPIPFilterProvider, ip net.IP) bool {
+	if provider == nil {
+		return true
+	}
+	return provider.IPFilter().Allowed(ip)
+}
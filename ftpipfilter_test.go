@@ -0,0 +1,50 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	Convey("An IP filter", t, func() {
+		Convey("Will reject invalid entries", func() {
+			_, err := NewFTPIPFilter([]string{"10.0.0.0/33"}, nil)
+			So(err, ShouldNotBeNil)
+			_, err = NewFTPIPFilter(nil, []string{"not-an-ip"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Without lists will allow everything", func() {
+			filter, err := NewFTPIPFilter(nil, nil)
+			So(err, ShouldBeNil)
+			So(filter.Allowed(net.ParseIP("192.0.2.1")), ShouldBeTrue)
+			So(filter.Allowed(net.ParseIP("2001:db8::1")), ShouldBeTrue)
+		})
+
+		Convey("With an allow list will only allow matching addresses", func() {
+			filter, err := NewFTPIPFilter([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"}, nil)
+			So(err, ShouldBeNil)
+			So(filter.Allowed(net.ParseIP("10.1.2.3")), ShouldBeTrue)
+			So(filter.Allowed(net.ParseIP("::ffff:10.1.2.3")), ShouldBeTrue)
+			So(filter.Allowed(net.ParseIP("2001:db8:1::1")), ShouldBeTrue)
+			So(filter.Allowed(net.ParseIP("192.0.2.7")), ShouldBeTrue)
+			So(filter.Allowed(net.ParseIP("192.0.2.8")), ShouldBeFalse)
+			So(filter.Allowed(net.ParseIP("2001:db9::1")), ShouldBeFalse)
+		})
+
+		Convey("Will let the deny list win over the allow list", func() {
+			filter, err := NewFTPIPFilter([]string{"10.0.0.0/8"}, []string{"10.6.6.0/24", "::1"})
+			So(err, ShouldBeNil)
+			So(filter.Allowed(net.ParseIP("10.1.2.3")), ShouldBeTrue)
+			So(filter.Allowed(net.ParseIP("10.6.6.6")), ShouldBeFalse)
+			So(filter.Allowed(net.ParseIP("::1")), ShouldBeFalse)
+		})
+
+		Convey("Will allow everything when nil", func() {
+			var filter *FTPIPFilter
+			So(filter.Allowed(net.ParseIP("10.1.2.3")), ShouldBeTrue)
+			So(ipAllowed(nil, net.ParseIP("10.1.2.3")), ShouldBeTrue)
+		})
+	})
+}
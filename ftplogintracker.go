@@ -0,0 +1,232 @@
+package graval
+
+import (
+	"sync"
+	"time"
+)
+
+// FTPLoginTrackerOpts configures the tracking of failed logins. Failures are
+// counted per remote IP address and per username. Every failure delays the
+// reply to the client, doubling the delay each time, and once too many
+// failures have been seen the IP address or username is temporarily banned.
+type FTPLoginTrackerOpts struct {
+	// The number of failed logins from a single IP address, or for a single
+	// username, before it is banned. Defaults to 5.
+	MaxFailures int
+
+	// The delay applied after the first failed login. It doubles with every
+	// further failure. Defaults to 1 second.
+	Delay time.Duration
+
+	// The upper bound for the delay after a failed login. Defaults to 30
+	// seconds.
+	MaxDelay time.Duration
+
+	// How long an IP address or username stays banned. Defaults to 15 minutes.
+	BanDuration time.Duration
+
+	// How long failures are remembered after the most recent one. Defaults
+	// to 15 minutes.
+	FailureWindow time.Duration
+
+	// Optional hooks that are notified about failures and bans, e.g. to
+	// persist bans or to feed them to fail2ban-style tooling.
+	Hooks FTPLoginHooks
+}
+
+// FTPLoginHooks receives notifications from the login tracker. Hooks are
+// called synchronously from the client connection, so implementations that
+// do slow work should hand it off to another goroutine.
+type FTPLoginHooks interface {
+	// LoginFailed is called for every failed login attempt
+	LoginFailed(ip string, user string, failures int)
+
+	// IPBanned is called when an IP address is banned by the tracker
+	IPBanned(ip string, until time.Time)
+
+	// UserBanned is called when a username is banned by the tracker
+	UserBanned(user string, until time.Time)
+}
+
+type loginRecord struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+type loginTracker struct {
+	opts  FTPLoginTrackerOpts
+	mu    sync.Mutex
+	ips   map[string]*loginRecord
+	users map[string]*loginRecord
+	now   func() time.Time
+}
+
+func newLoginTracker(opts *FTPLoginTrackerOpts) *loginTracker {
+	t := new(loginTracker)
+	t.opts = *opts
+	if t.opts.MaxFailures <= 0 {
+		t.opts.MaxFailures = 5
+	}
+	if t.opts.Delay <= 0 {
+		t.opts.Delay = time.Second
+	}
+	if t.opts.MaxDelay <= 0 {
+		t.opts.MaxDelay = 30 * time.Second
+	}
+	if t.opts.BanDuration <= 0 {
+		t.opts.BanDuration = 15 * time.Minute
+	}
+	if t.opts.FailureWindow <= 0 {
+		t.opts.FailureWindow = 15 * time.Minute
+	}
+	t.ips = make(map[string]*loginRecord)
+	t.users = make(map[string]*loginRecord)
+	t.now = time.Now
+	return t
+}
+
+// ipBanned returns true if the IP address is currently banned
+func (t *loginTracker) ipBanned(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.banned(t.ips, ip)
+}
+
+// userBanned returns true if the username is currently banned
+func (t *loginTracker) userBanned(user string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.banned(t.users, user)
+}
+
+func (t *loginTracker) banned(records map[string]*loginRecord, key string) bool {
+	record := records[key]
+	return record != nil && t.now().Before(record.bannedUntil)
+}
+
+// failed records a failed login and returns how long the client should be
+// delayed before it receives a reply.
+func (t *loginTracker) failed(ip string, user string) time.Duration {
+	t.mu.Lock()
+	now := t.now()
+	t.prune(now)
+	ipRecord := t.record(t.ips, ip, now)
+	userRecord := new(loginRecord)
+	if user != "" {
+		userRecord = t.record(t.users, user, now)
+	}
+
+	var ipBannedUntil, userBannedUntil time.Time
+	if ipRecord.failures >= t.opts.MaxFailures && !now.Before(ipRecord.bannedUntil) {
+		ipRecord.bannedUntil = now.Add(t.opts.BanDuration)
+		ipBannedUntil = ipRecord.bannedUntil
+	}
+	if userRecord.failures >= t.opts.MaxFailures && !now.Before(userRecord.bannedUntil) {
+		userRecord.bannedUntil = now.Add(t.opts.BanDuration)
+		userBannedUntil = userRecord.bannedUntil
+	}
+
+	failures := ipRecord.failures
+	if userRecord.failures > failures {
+		failures = userRecord.failures
+	}
+	t.mu.Unlock()
+
+	if hooks := t.opts.Hooks; hooks != nil {
+		hooks.LoginFailed(ip, user, failures)
+		if !ipBannedUntil.IsZero() {
+			hooks.IPBanned(ip, ipBannedUntil)
+		}
+		if !userBannedUntil.IsZero() {
+			hooks.UserBanned(user, userBannedUntil)
+		}
+	}
+	return t.delay(failures)
+}
+
+// succeeded forgets the failures recorded for a username after it logged in.
+// The failures of the IP address are kept, otherwise a client could reset them
+// by logging in to an account it knows between its guesses.
+func (t *loginTracker) succeeded(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.users, user)
+}
+
+func (t *loginTracker) record(records map[string]*loginRecord, key string, now time.Time) *loginRecord {
+	record := records[key]
+	if record == nil {
+		record = new(loginRecord)
+		records[key] = record
+	}
+	record.failures++
+	record.lastFailure = now
+	return record
+}
+
+func (t *loginTracker) delay(failures int) time.Duration {
+	delay := t.opts.Delay
+	for i := 1; i < failures && delay < t.opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.opts.MaxDelay {
+		delay = t.opts.MaxDelay
+	}
+	return delay
+}
+
+// prune drops records that are neither banned nor have recent failures
+func (t *loginTracker) prune(now time.Time) {
+	for _, records := range []map[string]*loginRecord{t.ips, t.users} {
+		for key, record := range records {
+			if now.Before(record.bannedUntil) {
+				continue
+			}
+			if now.Sub(record.lastFailure) > t.opts.FailureWindow {
+				delete(records, key)
+			} else if !record.bannedUntil.IsZero() {
+				// the ban expired, give the client a clean slate
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// banIP bans the IP address until the given time
+func (t *loginTracker) banIP(ip string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	record := t.ips[ip]
+	if record == nil {
+		record = new(loginRecord)
+		t.ips[ip] = record
+	}
+	record.bannedUntil = until
+}
+
+// unbanIP lifts a ban on the IP address and forgets its failures
+func (t *loginTracker) unbanIP(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.ips, ip)
+}
+
+// banUser bans the username until the given time
+func (t *loginTracker) banUser(user string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	record := t.users[user]
+	if record == nil {
+		record = new(loginRecord)
+		t.users[user] = record
+	}
+	record.bannedUntil = until
+}
+
+// unbanUser lifts a ban on the username and forgets its failures
+func (t *loginTracker) unbanUser(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.users, user)
+}
@@ -0,0 +1,99 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+type testLoginHooks struct {
+	failures    int
+	bannedIPs   []string
+	bannedUsers []string
+}
+
+func (hooks *testLoginHooks) LoginFailed(ip string, user string, failures int) {
+	hooks.failures++
+}
+
+func (hooks *testLoginHooks) IPBanned(ip string, until time.Time) {
+	hooks.bannedIPs = append(hooks.bannedIPs, ip)
+}
+
+func (hooks *testLoginHooks) UserBanned(user string, until time.Time) {
+	hooks.bannedUsers = append(hooks.bannedUsers, user)
+}
+
+func TestLoginTracker(t *testing.T) {
+	Convey("The login tracker", t, func() {
+		now := time.Unix(1566738000, 0)
+		hooks := &testLoginHooks{}
+		tracker := newLoginTracker(&FTPLoginTrackerOpts{
+			MaxFailures:   3,
+			Delay:         time.Second,
+			MaxDelay:      3 * time.Second,
+			BanDuration:   time.Minute,
+			FailureWindow: 10 * time.Minute,
+			Hooks:         hooks,
+		})
+		tracker.now = func() time.Time { return now }
+
+		Convey("Will double the delay up to the maximum", func() {
+			So(tracker.failed("10.0.0.1", "bob"), ShouldEqual, time.Second)
+			So(tracker.failed("10.0.0.1", "bob"), ShouldEqual, 2*time.Second)
+			So(tracker.failed("10.0.0.1", "bob"), ShouldEqual, 3*time.Second)
+			So(hooks.failures, ShouldEqual, 3)
+		})
+
+		Convey("Will ban the IP address and username after too many failures", func() {
+			tracker.failed("10.0.0.1", "bob")
+			tracker.failed("10.0.0.1", "bob")
+			So(tracker.ipBanned("10.0.0.1"), ShouldBeFalse)
+			tracker.failed("10.0.0.1", "bob")
+			So(tracker.ipBanned("10.0.0.1"), ShouldBeTrue)
+			So(tracker.userBanned("bob"), ShouldBeTrue)
+			So(tracker.ipBanned("10.0.0.2"), ShouldBeFalse)
+			So(hooks.bannedIPs, ShouldResemble, []string{"10.0.0.1"})
+			So(hooks.bannedUsers, ShouldResemble, []string{"bob"})
+		})
+
+		Convey("Will count failures for a username across IP addresses", func() {
+			tracker.failed("10.0.0.1", "bob")
+			tracker.failed("10.0.0.2", "bob")
+			tracker.failed("10.0.0.3", "bob")
+			So(tracker.userBanned("bob"), ShouldBeTrue)
+			So(tracker.ipBanned("10.0.0.1"), ShouldBeFalse)
+		})
+
+		Convey("Will lift bans once they expire", func() {
+			tracker.failed("10.0.0.1", "bob")
+			tracker.failed("10.0.0.1", "bob")
+			tracker.failed("10.0.0.1", "bob")
+			now = now.Add(2 * time.Minute)
+			So(tracker.ipBanned("10.0.0.1"), ShouldBeFalse)
+			So(tracker.failed("10.0.0.1", "bob"), ShouldEqual, time.Second)
+		})
+
+		Convey("Will forget the failures of a username after a successful login", func() {
+			tracker.failed("10.0.0.1", "bob")
+			tracker.failed("10.0.0.1", "bob")
+			tracker.succeeded("bob")
+			So(tracker.failed("10.0.0.2", "bob"), ShouldEqual, time.Second)
+		})
+
+		Convey("Will keep the failures of an IP address after a successful login", func() {
+			tracker.failed("10.0.0.1", "alice")
+			tracker.failed("10.0.0.1", "carol")
+			tracker.succeeded("bob")
+			So(tracker.failed("10.0.0.1", "dave"), ShouldEqual, 3*time.Second)
+			So(tracker.ipBanned("10.0.0.1"), ShouldBeTrue)
+		})
+
+		Convey("Will honour manual bans", func() {
+			tracker.banIP("10.0.0.9", now.Add(time.Hour))
+			So(tracker.ipBanned("10.0.0.9"), ShouldBeTrue)
+			tracker.unbanIP("10.0.0.9")
+			So(tracker.ipBanned("10.0.0.9"), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,110 @@
+package graval
+
+import (
+	"errors"
+	"time"
+)
+
+// FTPEventType identifies what happened in an FTPEvent
+type FTPEventType string
+
+const (
+	// EventConnected is sent when a client connected
+	EventConnected FTPEventType = "connected"
+	// EventDisconnected is sent when a client disconnected. Duration is how
+	// long it was connected.
+	EventDisconnected FTPEventType = "disconnected"
+	// EventLoginSucceeded is sent when a user logged in
+	EventLoginSucceeded FTPEventType = "login_succeeded"
+	// EventLoginFailed is sent when a login failed or was refused. Err is
+	// ErrUserBanned, ErrLoginNotAllowed, ErrTooManySessions or the error of
+	// the driver, and nil for a wrong password.
+	EventLoginFailed FTPEventType = "login_failed"
+	// EventUploadStarted is sent when an upload starts, after the client was
+	// told to send the data and before any of it was read
+	EventUploadStarted FTPEventType = "upload_started"
+	// EventUploadCompleted is sent when an upload was stored
+	EventUploadCompleted FTPEventType = "upload_completed"
+	// EventUploadFailed is sent when an upload was aborted or couldn't be
+	// stored
+	EventUploadFailed FTPEventType = "upload_failed"
+	// EventDownloadCompleted is sent when a download completed
+	EventDownloadCompleted FTPEventType = "download_completed"
+	// EventDownloadFailed is sent when a download was aborted or failed
+	EventDownloadFailed FTPEventType = "download_failed"
+	// EventDeleted is sent when a file was deleted
+	EventDeleted FTPEventType = "deleted"
+	// EventRenamed is sent when a file or directory was renamed. FromPath
+	// is the old path.
+	EventRenamed FTPEventType = "renamed"
+	// EventDirCreated is sent when a directory was created
+	EventDirCreated FTPEventType = "dir_created"
+	// EventDirRemoved is sent when a directory was deleted
+	EventDirRemoved FTPEventType = "dir_removed"
+)
+
+var (
+	// ErrUserBanned is the error of EventLoginFailed when the user is
+	// temporarily banned after too many failed logins
+	ErrUserBanned = errors.New("user is banned after too many failed logins")
+
+	// ErrLoginNotAllowed is the error of EventLoginFailed when the user may
+	// not log in from the address of the client
+	ErrLoginNotAllowed = errors.New("login not allowed from this address")
+
+	// ErrTooManySessions is the error of EventLoginFailed when the user
+	// reached their maximum number of sessions
+	ErrTooManySessions = errors.New("too many sessions for this user")
+)
+
+// FTPEvent describes something that happened in a client session. Paths are
+// absolute paths as the client sees them.
+type FTPEvent struct {
+	Type      FTPEventType
+	Time      time.Time
+	SessionID string
+	RemoteIP  string
+
+	// The logged in user, or the user that tried to log in
+	User string
+
+	// The path of the file or directory, if the event is about one
+	Path string
+
+	// The old path of a renamed file or directory
+	FromPath string
+
+	// The number of bytes transferred, for uploads and downloads
+	Bytes int64
+
+	// How long the transfer or the connection took
+	Duration time.Duration
+
+	// Why a login or a transfer failed
+	Err error
+}
+
+// FTPNotifier receives the events of all client sessions of a server, e.g.
+// to process uploaded files. Notify is called synchronously from the client
+// connection, so implementations that do slow work should hand it off to
+// another goroutine.
+type FTPNotifier interface {
+	Notify(event FTPEvent)
+}
+
+// notify sends an event to the notifier of the server, if it has one. The
+// session details of the event are filled in.
+func (ftpConn *ftpConn) notify(event FTPEvent) {
+	notifier := ftpConn.server.notifier
+	if notifier == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.SessionID = ftpConn.sessionId
+	event.RemoteIP = ftpConn.remoteIP()
+	if event.User == "" {
+		event.User = ftpConn.user
+	}
+	notifier.Notify(event)
+}
@@ -0,0 +1,79 @@
+package graval
+
+import (
+	"strings"
+)
+
+// FTPPermission is a set of operations a user may perform. Combine them with
+// the | operator.
+type FTPPermission uint16
+
+const (
+	// PermList allows listing the contents of directories
+	PermList FTPPermission = 1 << iota
+	// PermDownload allows downloading files
+	PermDownload
+	// PermUpload allows uploading new files
+	PermUpload
+	// PermOverwrite allows uploading files that replace existing ones
+	PermOverwrite
+	// PermDelete allows deleting files
+	PermDelete
+	// PermRename allows renaming files, the permission is required for both
+	// the old and the new path
+	PermRename
+	// PermMkdir allows creating directories
+	PermMkdir
+	// PermRmdir allows deleting directories
+	PermRmdir
+	// PermChmod allows changing the mode of files and directories
+	PermChmod
+
+	// PermNone allows nothing
+	PermNone FTPPermission = 0
+	// PermReadOnly allows listing and downloading
+	PermReadOnly = PermList | PermDownload
+	// PermAll allows everything
+	PermAll = PermList | PermDownload | PermUpload | PermOverwrite | PermDelete | PermRename | PermMkdir | PermRmdir | PermChmod
+)
+
+// FTPPathPermissions grants permissions for a path and everything below it
+type FTPPathPermissions struct {
+	// An absolute path as seen by the client, like "/incoming"
+	Path string
+
+	Permissions FTPPermission
+}
+
+// FTPPermissions describes what a user may do. graval checks them before
+// calling the driver and replies with 550 when an operation is denied.
+type FTPPermissions struct {
+	// The permissions for paths that don't match any of the rules
+	Default FTPPermission
+
+	// Permissions for specific paths. When several rules match a path, the
+	// one with the longest path wins.
+	Rules []FTPPathPermissions
+}
+
+// Allowed returns true if the permissions include perm for path. A nil
+// FTPPermissions allows everything.
+func (permissions *FTPPermissions) Allowed(perm FTPPermission, path string) bool {
+	if permissions == nil {
+		return true
+	}
+
+	granted := permissions.Default
+	longest := -1
+	for _, rule := range permissions.Rules {
+		prefix := strings.TrimSuffix(rule.Path, "/")
+		if len(prefix) <= longest {
+			continue
+		}
+		if path == prefix || prefix == "" || strings.HasPrefix(path, prefix+"/") {
+			granted = rule.Permissions
+			longest = len(prefix)
+		}
+	}
+	return granted&perm == perm
+}
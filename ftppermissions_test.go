@@ -0,0 +1,44 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	Convey("Permissions", t, func() {
+		permissions := &FTPPermissions{
+			Default: PermReadOnly,
+			Rules: []FTPPathPermissions{
+				{Path: "/incoming", Permissions: PermList | PermUpload},
+				{Path: "/incoming/private/", Permissions: PermNone},
+			},
+		}
+
+		Convey("Will use the default for paths without a rule", func() {
+			So(permissions.Allowed(PermDownload, "/file.txt"), ShouldBeTrue)
+			So(permissions.Allowed(PermUpload, "/file.txt"), ShouldBeFalse)
+		})
+
+		Convey("Will apply a rule to its path and everything below it", func() {
+			So(permissions.Allowed(PermList, "/incoming"), ShouldBeTrue)
+			So(permissions.Allowed(PermUpload, "/incoming/file.txt"), ShouldBeTrue)
+			So(permissions.Allowed(PermDownload, "/incoming/file.txt"), ShouldBeFalse)
+			So(permissions.Allowed(PermUpload, "/incomingfile.txt"), ShouldBeFalse)
+		})
+
+		Convey("Will prefer the rule with the longest path", func() {
+			So(permissions.Allowed(PermList, "/incoming/private"), ShouldBeFalse)
+			So(permissions.Allowed(PermUpload, "/incoming/private/file.txt"), ShouldBeFalse)
+		})
+
+		Convey("Will require every requested permission", func() {
+			So(permissions.Allowed(PermUpload|PermOverwrite, "/incoming/file.txt"), ShouldBeFalse)
+		})
+
+		Convey("Will allow everything when nil", func() {
+			var none *FTPPermissions
+			So(none.Allowed(PermAll, "/file.txt"), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,102 @@
+package graval
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrQuotaExceeded is returned by the reader handed to FTPDriver.PutFile when
+// the upload exceeds the storage quota of the user. Drivers should discard
+// the partial file when they see it.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// FTPQuota describes the storage limits of a user and how much of them is
+// in use. A limit of 0 means unlimited.
+type FTPQuota struct {
+	MaxBytes  int64
+	UsedBytes int64
+	MaxFiles  int64
+	UsedFiles int64
+}
+
+// AvailableBytes returns how many more bytes the user may store, or -1 if
+// the number of bytes is unlimited.
+func (quota *FTPQuota) AvailableBytes() int64 {
+	if quota.MaxBytes <= 0 {
+		return -1
+	}
+	if quota.UsedBytes >= quota.MaxBytes {
+		return 0
+	}
+	return quota.MaxBytes - quota.UsedBytes
+}
+
+// FTPQuotaProvider looks up and updates the storage quotas of users. Provide
+// an implementation with the QuotaProvider option of FTPServerOpts to have
+// graval enforce quotas on uploads.
+type FTPQuotaProvider interface {
+	// params  - username
+	// returns - the quota of the user, or nil if the user has no quota
+	Quota(string) (*FTPQuota, error)
+
+	// params  - username, change in bytes, change in number of files
+	// returns - an error if the new usage couldn't be recorded
+	AddUsage(string, int64, int64) error
+}
+
+// uploadLimitReader fails with err once more than limit bytes were read from
+// the reader. A negative limit means unlimited.
+type uploadLimitReader struct {
+	reader io.Reader
+	limit  int64
+	err    error
+	read   int64
+	failed bool
+}
+
+func newUploadLimitReader(reader io.Reader, limit int64, err error) *uploadLimitReader {
+	return &uploadLimitReader{reader: reader, limit: limit, err: err}
+}
+
+func (r *uploadLimitReader) Read(p []byte) (int, error) {
+	if r.failed {
+		return 0, r.err
+	}
+
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.limit >= 0 && r.read > r.limit {
+		r.failed = true
+		n -= int(r.read - r.limit)
+		r.read = r.limit
+		return n, r.err
+	}
+	return n, err
+}
+
+// exceeded returns true if the reader hit its limit
+func (r *uploadLimitReader) exceeded() bool {
+	return r.failed
+}
+
+// addUsage records a change of the storage used by the logged in user, if
+// the server enforces quotas
+func (ftpConn *ftpConn) addUsage(bytes int64, files int64) {
+	provider := ftpConn.server.quotaProvider
+	if provider == nil {
+		return
+	}
+	if err := provider.AddUsage(ftpConn.user, bytes, files); err != nil && ftpConn.logger != nil {
+		ftpConn.logger.Warnf("failed to record storage usage of %s %v", ftpConn.user, err)
+	}
+}
+
+// usedBytes returns the size of the file at path, which counts towards the
+// quota of the logged in user, or -1 if there is no such file or the server
+// doesn't enforce quotas.
+func (ftpConn *ftpConn) usedBytes(path string) (int64, error) {
+	if ftpConn.server.quotaProvider == nil {
+		return -1, nil
+	}
+	return ftpConn.driver.Bytes(ftpConn.driverPath(path))
+}
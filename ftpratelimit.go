@@ -0,0 +1,199 @@
+package graval
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that limits the number of bytes per second
+// that can pass through it. The limit can be changed at any time, also while
+// transfers are running. A limit of 0 or less means unlimited.
+//
+// A single RateLimiter can be shared by any number of transfers, they then
+// split the available bandwidth between them.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter that allows bytesPerSecond
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	limiter := new(RateLimiter)
+	limiter.SetLimit(bytesPerSecond)
+	return limiter
+}
+
+// SetLimit changes the number of bytes per second the limiter allows
+func (limiter *RateLimiter) SetLimit(bytesPerSecond int64) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.limit = bytesPerSecond
+	limiter.tokens = 0
+	limiter.last = time.Now()
+}
+
+// Limit returns the number of bytes per second the limiter allows
+func (limiter *RateLimiter) Limit() int64 {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.limit
+}
+
+// take reserves n bytes and returns how long the caller has to wait before
+// they may be transferred.
+func (limiter *RateLimiter) take(n int) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.limit <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * float64(limiter.limit)
+	limiter.last = now
+	// allow bursts of up to one second worth of data
+	if limiter.tokens > float64(limiter.limit) {
+		limiter.tokens = float64(limiter.limit)
+	}
+
+	limiter.tokens -= float64(n)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / float64(limiter.limit) * float64(time.Second))
+}
+
+// wait blocks until n bytes may be transferred
+func (limiter *RateLimiter) wait(n int) {
+	if delay := limiter.take(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// chunkSize returns how many bytes should be transferred at once, so that
+// transfers through a slow limiter still make progress in small steps.
+func (limiter *RateLimiter) chunkSize(max int) int {
+	limit := limiter.Limit()
+	if limit <= 0 || int64(max) <= limit/10 {
+		return max
+	}
+	if limit < 10 {
+		return 1
+	}
+	return int(limit / 10)
+}
+
+// rateLimitedReader passes data through a number of rate limiters, all of
+// which have to allow it before it's returned.
+type rateLimitedReader struct {
+	reader   io.Reader
+	limiters []*RateLimiter
+}
+
+// newRateLimitedReader wraps reader with the limiters that are not nil. If
+// there are none the reader is returned unchanged.
+func newRateLimitedReader(reader io.Reader, limiters ...*RateLimiter) io.Reader {
+	r := &rateLimitedReader{reader: reader}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			r.limiters = append(r.limiters, limiter)
+		}
+	}
+	if len(r.limiters) == 0 {
+		return reader
+	}
+	return r
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	size := len(p)
+	for _, limiter := range r.limiters {
+		size = limiter.chunkSize(size)
+	}
+
+	n, err := r.reader.Read(p[:size])
+	for _, limiter := range r.limiters {
+		limiter.wait(n)
+	}
+	return n, err
+}
+
+// rateLimits holds the upload and download limiters of a single scope
+type rateLimits struct {
+	upload   *RateLimiter
+	download *RateLimiter
+}
+
+func newRateLimits(upload int64, download int64) *rateLimits {
+	return &rateLimits{
+		upload:   NewRateLimiter(upload),
+		download: NewRateLimiter(download),
+	}
+}
+
+// userRateLimits hands out the limiters shared by all sessions of a user.
+// The limiters of a user are dropped when their last session ended.
+type userRateLimits struct {
+	mu     sync.Mutex
+	limits map[string]*userRateLimit
+}
+
+// userRateLimit holds the limiters of a user and counts their sessions
+type userRateLimit struct {
+	*rateLimits
+	sessions int
+}
+
+func newUserRateLimits() *userRateLimits {
+	return &userRateLimits{limits: make(map[string]*userRateLimit)}
+}
+
+// acquire counts a new session of user and returns the limiters of the user,
+// which are set to the given limits. The limits come from the settings of the
+// user, so changes to them apply from the next login on.
+func (u *userRateLimits) acquire(user string, upload int64, download int64) *rateLimits {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	limits := u.limits[user]
+	if limits == nil {
+		limits = &userRateLimit{rateLimits: newRateLimits(upload, download)}
+		u.limits[user] = limits
+	} else {
+		// setting a limit resets the bucket, which would briefly stall the
+		// other sessions of the user
+		if limits.upload.Limit() != upload {
+			limits.upload.SetLimit(upload)
+		}
+		if limits.download.Limit() != download {
+			limits.download.SetLimit(download)
+		}
+	}
+	limits.sessions++
+	return limits.rateLimits
+}
+
+// release forgets a session counted by acquire
+func (u *userRateLimits) release(user string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	limits := u.limits[user]
+	if limits == nil {
+		return
+	}
+	if limits.sessions--; limits.sessions <= 0 {
+		delete(u.limits, user)
+	}
+}
+
+// get returns the limiters of user, or nil if the user has no sessions
+func (u *userRateLimits) get(user string) *rateLimits {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if limits := u.limits[user]; limits != nil {
+		return limits.rateLimits
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package graval
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 2000)
+
+	Convey("A rate limited reader", t, func() {
+		Convey("Will not slow down reads without a limit", func() {
+			reader := newRateLimitedReader(bytes.NewReader(data), NewRateLimiter(0))
+			start := time.Now()
+			read, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(read, ShouldResemble, data)
+			So(time.Since(start), ShouldBeLessThan, 50*time.Millisecond)
+		})
+
+		Convey("Will slow down reads to the limit", func() {
+			reader := newRateLimitedReader(bytes.NewReader(data), NewRateLimiter(10000))
+			start := time.Now()
+			read, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(read, ShouldResemble, data)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+		})
+
+		Convey("Will apply the strictest of several limiters", func() {
+			reader := newRateLimitedReader(bytes.NewReader(data), NewRateLimiter(0), NewRateLimiter(10000), nil)
+			start := time.Now()
+			_, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+		})
+
+		Convey("Will follow limit changes during a transfer", func() {
+			limiter := NewRateLimiter(1000)
+			reader := newRateLimitedReader(bytes.NewReader(data), limiter)
+			buf := make([]byte, 100)
+			_, err := reader.Read(buf)
+			So(err, ShouldBeNil)
+			limiter.SetLimit(0)
+			So(limiter.Limit(), ShouldEqual, 0)
+			start := time.Now()
+			_, err = ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, 50*time.Millisecond)
+		})
+	})
+
+	Convey("Wrapping a reader without limiters", t, func() {
+		reader := bytes.NewReader(data)
+		Convey("Will return the reader unchanged", func() {
+			So(newRateLimitedReader(reader, nil, nil), ShouldEqual, reader)
+		})
+	})
+}
+
+func TestUserRateLimits(t *testing.T) {
+	Convey("The limiters of users", t, func() {
+		limits := newUserRateLimits()
+
+		Convey("Will be shared by the sessions of a user", func() {
+			first := limits.acquire("bob", 1000, 2000)
+			second := limits.acquire("bob", 1000, 2000)
+			So(second, ShouldEqual, first)
+			So(limits.get("bob").upload.Limit(), ShouldEqual, 1000)
+			So(limits.get("bob").download.Limit(), ShouldEqual, 2000)
+			So(limits.get("alice"), ShouldBeNil)
+		})
+
+		Convey("Will apply the current limits on every login", func() {
+			first := limits.acquire("bob", 1000, 2000)
+			limits.acquire("bob", 3000, 0)
+			So(first.upload.Limit(), ShouldEqual, 3000)
+			So(first.download.Limit(), ShouldEqual, 0)
+		})
+
+		Convey("Will be dropped when the last session ended", func() {
+			limits.acquire("bob", 1000, 2000)
+			limits.acquire("bob", 1000, 2000)
+			limits.release("bob")
+			So(limits.get("bob"), ShouldNotBeNil)
+			limits.release("bob")
+			So(limits.get("bob"), ShouldBeNil)
+			So(limits.limits, ShouldBeEmpty)
+		})
+	})
+}
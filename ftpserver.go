@@ -48,6 +48,118 @@ type FTPServerOpts struct {
 
 	// The logger implementation
 	Logger FTPLogger
+
+	// How long a client may stay connected without sending a command before
+	// it is disconnected with a 421 reply. Optional, defaults to 0 which
+	// disables the timeout.
+	IdleTimeout time.Duration
+
+	// How long a client may stay connected without logging in before it is
+	// disconnected with a 421 reply. Optional, defaults to 0 which disables
+	// the timeout.
+	LoginTimeout time.Duration
+
+	// How long to wait for a data connection to be established, either for
+	// the client to connect to a passive socket or for the server to connect
+	// to an active one. Optional, defaults to 30 seconds.
+	DataConnectionTimeout time.Duration
+
+	// How long a read or write on an established data connection may block
+	// before the transfer is aborted. Optional, defaults to 0 which disables
+	// the timeout.
+	DataTransferTimeout time.Duration
+
+	// The number of PASS attempts a client may make on a single connection
+	// before it is disconnected. Optional, defaults to 3.
+	MaxLoginAttempts int
+
+	// How long to wait before replying to a failed PASS attempt. Optional,
+	// defaults to 0 which means 1 second. A negative value disables the
+	// delay. When the LoginTracker option is used and it asks for a longer
+	// delay, that delay is used instead.
+	LoginFailureDelay time.Duration
+
+	// The maximum number of simultaneous client connections. Clients that
+	// connect while the limit is reached receive a 421 reply. Optional,
+	// defaults to 0 which means unlimited.
+	MaxConnections int
+
+	// The maximum number of simultaneous client connections from a single
+	// IP address. Optional, defaults to 0 which means unlimited.
+	MaxConnectionsPerIP int
+
+	// The maximum number of simultaneous logged in sessions for a single
+	// user. Drivers can override it per user with FTPUserOpts. Optional,
+	// defaults to 0 which means unlimited.
+	MaxSessionsPerUser int
+
+	// The maximum number of bytes per second all clients together may upload
+	// and download. Both limits can be changed while the server is running
+	// with UploadRateLimiter() and DownloadRateLimiter(). Optional, defaults
+	// to 0 which means unlimited.
+	UploadRateLimit   int64
+	DownloadRateLimit int64
+
+	// The maximum number of bytes per second a single client connection may
+	// upload and download. Optional, defaults to 0 which means unlimited.
+	SessionUploadRateLimit   int64
+	SessionDownloadRateLimit int64
+
+	// Restricts the names of files and directories that clients create.
+	// Optional, defaults to nil which allows any name.
+	FilenamePolicy *FTPFilenamePolicy
+
+	// The maximum size of a single uploaded file in bytes. Uploads that grow
+	// larger are aborted with a 552 reply. Drivers can override it per user
+	// with FTPUserOpts. Optional, defaults to 0 which means unlimited.
+	MaxUploadSize int64
+
+	// Use this option to write uploads to a temporary file first, and only
+	// rename it to the requested name once the transfer completed. Clients
+	// can't list or access the temporary files of uploads in progress, and
+	// they're deleted if the upload fails. Optional, defaults to false.
+	AtomicUploads bool
+
+	// The name of temporary upload files, in the same directory as the
+	// target. "{name}" is replaced by the name of the target and "{session}"
+	// by a unique id of the client connection. Optional, defaults to
+	// ".{name}.{session}.part".
+	AtomicUploadPattern string
+
+	// Enforces storage quotas on uploads and powers the AVBL command.
+	// Optional, defaults to nil which means users have no quota.
+	QuotaProvider FTPQuotaProvider
+
+	// Restricts the addresses that clients may connect from. Clients that are
+	// not allowed are rejected before a driver is created for them. Optional,
+	// defaults to nil which allows any address.
+	IPFilter FTPIPFilterProvider
+
+	// Use this option to track failed logins, delay replies to clients that
+	// keep failing and temporarily ban them. Optional, defaults to nil which
+	// disables tracking.
+	LoginTracker *FTPLoginTrackerOpts
+
+	// SITE subcommands of the application, keyed by their name like
+	// "REINDEX". They are added to the built-in ones like SITE CHMOD and
+	// replace them if they have the same name. Optional.
+	SiteCommands map[string]FTPCommand
+
+	// Commands of the application, keyed by their verb like "XREINDEX". They
+	// are added to the built-in commands and replace them if they have the
+	// same verb, so they can change how a command like LIST behaves. A nil
+	// command removes the built-in one. The commands only apply to this
+	// server. Optional.
+	Commands map[string]FTPCommand
+
+	// Interceptors that wrap the execution of every command, to audit, limit
+	// or veto commands. The first one is called first and decides whether
+	// the next ones run. Optional.
+	Interceptors []FTPInterceptor
+
+	// Receives events like logins and completed uploads of all client
+	// sessions. Optional.
+	Notifier FTPNotifier
 }
 
 // FTPServer is the root of your FTP application. You should instantiate one
@@ -55,14 +167,40 @@ type FTPServerOpts struct {
 //
 // Always use the NewFTPServer() method to create a new FTPServer.
 type FTPServer struct {
-	serverName       string
-	listenTo         string
-	driverFactory    FTPDriverFactory
-	logger           FTPLogger
-	pasvMinPort      uint16
-	pasvMaxPort      uint16
-	pasvAdvertisedIp string
-	closeChan        chan struct{}
+	serverName               string
+	listenTo                 string
+	driverFactory            FTPDriverFactory
+	logger                   FTPLogger
+	pasvMinPort              uint16
+	pasvMaxPort              uint16
+	pasvAdvertisedIp         string
+	idleTimeout              time.Duration
+	loginTimeout             time.Duration
+	dataConnectionTimeout    time.Duration
+	dataTransferTimeout      time.Duration
+	maxLoginAttempts         int
+	loginFailureDelay        time.Duration
+	maxConnections           int
+	maxConnectionsPerIP      int
+	maxSessionsPerUser       int
+	connections              *connCounter
+	rateLimits               *rateLimits
+	userRateLimits           *userRateLimits
+	sessionUploadRateLimit   int64
+	sessionDownloadRateLimit int64
+	filenamePolicy           *FTPFilenamePolicy
+	maxUploadSize            int64
+	atomicUploads            bool
+	atomicUploadPattern      string
+	pendingUploads           *pendingUploads
+	quotaProvider            FTPQuotaProvider
+	ipFilter                 FTPIPFilterProvider
+	loginTracker             *loginTracker
+	siteCommands             map[string]FTPCommand
+	commands                 commandMap
+	interceptors             []FTPInterceptor
+	notifier                 FTPNotifier
+	closeChan                chan struct{}
 }
 
 // serverOptsWithDefaults copies an FTPServerOpts struct into a new struct,
@@ -92,11 +230,57 @@ func serverOptsWithDefaults(opts *FTPServerOpts) *FTPServerOpts {
 		newOpts.Port = opts.Port
 	}
 
+	if opts.DataConnectionTimeout <= 0 {
+		newOpts.DataConnectionTimeout = 30 * time.Second
+	} else {
+		newOpts.DataConnectionTimeout = opts.DataConnectionTimeout
+	}
+
+	if opts.AtomicUploadPattern == "" {
+		newOpts.AtomicUploadPattern = defaultAtomicUploadPattern
+	} else {
+		newOpts.AtomicUploadPattern = opts.AtomicUploadPattern
+	}
+
+	if opts.MaxLoginAttempts <= 0 {
+		newOpts.MaxLoginAttempts = 3
+	} else {
+		newOpts.MaxLoginAttempts = opts.MaxLoginAttempts
+	}
+
+	if opts.LoginFailureDelay == 0 {
+		newOpts.LoginFailureDelay = time.Second
+	} else if opts.LoginFailureDelay < 0 {
+		newOpts.LoginFailureDelay = 0
+	} else {
+		newOpts.LoginFailureDelay = opts.LoginFailureDelay
+	}
+
 	newOpts.PasvMinPort = opts.PasvMinPort
 	newOpts.PasvMaxPort = opts.PasvMaxPort
 	newOpts.PasvAdvertisedIp = opts.PasvAdvertisedIp
 	newOpts.Factory = opts.Factory
 	newOpts.Logger = opts.Logger
+	newOpts.IdleTimeout = opts.IdleTimeout
+	newOpts.LoginTimeout = opts.LoginTimeout
+	newOpts.DataTransferTimeout = opts.DataTransferTimeout
+	newOpts.MaxConnections = opts.MaxConnections
+	newOpts.MaxConnectionsPerIP = opts.MaxConnectionsPerIP
+	newOpts.MaxSessionsPerUser = opts.MaxSessionsPerUser
+	newOpts.UploadRateLimit = opts.UploadRateLimit
+	newOpts.DownloadRateLimit = opts.DownloadRateLimit
+	newOpts.SessionUploadRateLimit = opts.SessionUploadRateLimit
+	newOpts.SessionDownloadRateLimit = opts.SessionDownloadRateLimit
+	newOpts.FilenamePolicy = opts.FilenamePolicy
+	newOpts.MaxUploadSize = opts.MaxUploadSize
+	newOpts.AtomicUploads = opts.AtomicUploads
+	newOpts.QuotaProvider = opts.QuotaProvider
+	newOpts.IPFilter = opts.IPFilter
+	newOpts.LoginTracker = opts.LoginTracker
+	newOpts.SiteCommands = opts.SiteCommands
+	newOpts.Commands = opts.Commands
+	newOpts.Interceptors = opts.Interceptors
+	newOpts.Notifier = opts.Notifier
 
 	return &newOpts
 }
@@ -128,6 +312,34 @@ func NewFTPServer(opts *FTPServerOpts) *FTPServer {
 	s.pasvMinPort = opts.PasvMinPort
 	s.pasvMaxPort = opts.PasvMaxPort
 	s.pasvAdvertisedIp = opts.PasvAdvertisedIp
+	s.idleTimeout = opts.IdleTimeout
+	s.loginTimeout = opts.LoginTimeout
+	s.dataConnectionTimeout = opts.DataConnectionTimeout
+	s.dataTransferTimeout = opts.DataTransferTimeout
+	s.maxLoginAttempts = opts.MaxLoginAttempts
+	s.loginFailureDelay = opts.LoginFailureDelay
+	s.maxConnections = opts.MaxConnections
+	s.maxConnectionsPerIP = opts.MaxConnectionsPerIP
+	s.maxSessionsPerUser = opts.MaxSessionsPerUser
+	s.connections = newConnCounter()
+	s.rateLimits = newRateLimits(opts.UploadRateLimit, opts.DownloadRateLimit)
+	s.userRateLimits = newUserRateLimits()
+	s.sessionUploadRateLimit = opts.SessionUploadRateLimit
+	s.sessionDownloadRateLimit = opts.SessionDownloadRateLimit
+	s.filenamePolicy = opts.FilenamePolicy
+	s.maxUploadSize = opts.MaxUploadSize
+	s.atomicUploads = opts.AtomicUploads
+	s.atomicUploadPattern = opts.AtomicUploadPattern
+	s.pendingUploads = newPendingUploads()
+	s.quotaProvider = opts.QuotaProvider
+	s.ipFilter = opts.IPFilter
+	if opts.LoginTracker != nil {
+		s.loginTracker = newLoginTracker(opts.LoginTracker)
+	}
+	s.siteCommands = newSiteCommands(opts.SiteCommands)
+	s.commands = newCommandMap(opts.Commands)
+	s.interceptors = append([]FTPInterceptor(nil), opts.Interceptors...)
+	s.notifier = opts.Notifier
 	s.closeChan = make(chan struct{})
 	return s
 }
@@ -173,14 +385,45 @@ func (ftpServer *FTPServer) ListenAndServe() error {
 				return err
 			}
 
+			remoteAddr := tcpConn.RemoteAddr().(*net.TCPAddr)
+			if !ipAllowed(ftpServer.ipFilter, remoteAddr.IP) {
+				if ftpServer.logger != nil {
+					ftpServer.logger.Infof("Rejecting connection from filtered address %s", remoteAddr.IP)
+				}
+				ftpServer.rejectConn(tcpConn, 421, "Connections from your address are not allowed.")
+				continue
+			}
+
+			remoteIP := remoteAddr.IP.String()
+			if ftpServer.loginTracker != nil && ftpServer.loginTracker.ipBanned(remoteIP) {
+				if ftpServer.logger != nil {
+					ftpServer.logger.Infof("Rejecting connection from banned address %s", remoteIP)
+				}
+				ftpServer.rejectConn(tcpConn, 421, "Too many failed logins, try again later.")
+				continue
+			}
+
+			if !ftpServer.connections.acquireConn(remoteIP, ftpServer.maxConnections, ftpServer.maxConnectionsPerIP) {
+				if ftpServer.logger != nil {
+					ftpServer.logger.Infof("Rejecting connection from %s, too many connections", remoteIP)
+				}
+				ftpServer.rejectConn(tcpConn, 421, "Too many connections")
+				continue
+			}
+
 			driver, err := ftpServer.driverFactory.NewDriver()
 			if err != nil {
 				if ftpServer.logger != nil {
 					ftpServer.logger.Errorf("Error creating driver, aborting client connection %v", err)
 				}
+				ftpServer.connections.releaseConn(remoteIP)
+				tcpConn.Close()
 			} else {
-				ftpConn := newFtpConn(tcpConn, driver, ftpServer.logger, ftpServer.serverName, ftpServer.pasvMinPort, ftpServer.pasvMaxPort, ftpServer.pasvAdvertisedIp)
-				go ftpConn.Serve()
+				ftpConn := newFtpConn(tcpConn, driver, ftpServer)
+				go func() {
+					defer ftpServer.connections.releaseConn(remoteIP)
+					ftpConn.Serve()
+				}()
 			}
 
 		}
@@ -197,6 +440,79 @@ func (ftpServer *FTPServer) Close() {
 	}
 }
 
+// Stats returns a snapshot of the connection counters of the server.
+func (ftpServer *FTPServer) Stats() FTPServerStats {
+	return ftpServer.connections.stats()
+}
+
+// UploadRateLimiter returns the limiter shared by the uploads of all clients.
+// Use it to change the global upload limit while the server is running.
+func (ftpServer *FTPServer) UploadRateLimiter() *RateLimiter {
+	return ftpServer.rateLimits.upload
+}
+
+// DownloadRateLimiter returns the limiter shared by the downloads of all
+// clients. Use it to change the global download limit while the server is
+// running.
+func (ftpServer *FTPServer) DownloadRateLimiter() *RateLimiter {
+	return ftpServer.rateLimits.download
+}
+
+// UserRateLimiters returns the upload and download limiters shared by all
+// sessions of a user, or nil if the user isn't logged in. Use them to change
+// the limits of a user while the server is running. The limits from the
+// FTPUserOpts of the user are applied again on every login, and the limiters
+// are dropped when the last session of the user ended.
+func (ftpServer *FTPServer) UserRateLimiters(user string) (upload *RateLimiter, download *RateLimiter) {
+	limits := ftpServer.userRateLimits.get(user)
+	if limits == nil {
+		return nil, nil
+	}
+	return limits.upload, limits.download
+}
+
+// BanIP bans an IP address from connecting until the given time. Use it to
+// restore bans that were persisted by FTPLoginHooks. It has no effect unless
+// the server was created with the LoginTracker option.
+func (ftpServer *FTPServer) BanIP(ip string, until time.Time) {
+	if ftpServer.loginTracker != nil {
+		ftpServer.loginTracker.banIP(ip, until)
+	}
+}
+
+// UnbanIP lifts a ban on an IP address and forgets its failed logins.
+func (ftpServer *FTPServer) UnbanIP(ip string) {
+	if ftpServer.loginTracker != nil {
+		ftpServer.loginTracker.unbanIP(ip)
+	}
+}
+
+// BanUser bans a username from logging in until the given time.
+func (ftpServer *FTPServer) BanUser(user string, until time.Time) {
+	if ftpServer.loginTracker != nil {
+		ftpServer.loginTracker.banUser(user, until)
+	}
+}
+
+// UnbanUser lifts a ban on a username and forgets its failed logins.
+func (ftpServer *FTPServer) UnbanUser(user string) {
+	if ftpServer.loginTracker != nil {
+		ftpServer.loginTracker.unbanUser(user)
+	}
+}
+
+// rejectConn sends a single reply to a client that is not allowed to connect
+// and closes the connection.
+func (ftpServer *FTPServer) rejectConn(tcpConn *net.TCPConn, code int, message string) {
+	tcpConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(tcpConn, "%d %s\r\n", code, message); err != nil && ftpServer.logger != nil {
+		ftpServer.logger.Debugf("failed to send reply to rejected client %v", err)
+	}
+	if err := tcpConn.Close(); err != nil && ftpServer.logger != nil {
+		ftpServer.logger.Debugf("failed to close rejected connection %v", err)
+	}
+}
+
 func buildTcpString(hostname string, port uint16) (result string) {
 	if strings.Contains(hostname, ":") {
 		// ipv6
@@ -88,3 +88,21 @@ func TestCloseHammer(t *testing.T) {
 
 	})
 }
+
+func TestLoginFailureDelay(t *testing.T) {
+	Convey("The delay after a failed login", t, func() {
+		Convey("Defaults to 1 second", func() {
+			So(serverOptsWithDefaults(nil).LoginFailureDelay, ShouldEqual, time.Second)
+		})
+
+		Convey("Is disabled by a negative value", func() {
+			opts := serverOptsWithDefaults(&FTPServerOpts{LoginFailureDelay: -1})
+			So(opts.LoginFailureDelay, ShouldEqual, 0)
+		})
+
+		Convey("Can be changed", func() {
+			opts := serverOptsWithDefaults(&FTPServerOpts{LoginFailureDelay: 5 * time.Second})
+			So(opts.LoginFailureDelay, ShouldEqual, 5*time.Second)
+		})
+	})
+}
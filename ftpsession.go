@@ -0,0 +1,197 @@
+package graval
+
+import (
+	"io"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// FTPSession is the client connection a custom command runs in. graval
+// implements it and hands it to FTPCommand handlers, which use it to learn
+// about the client and to reply.
+type FTPSession interface {
+	// User returns the name of the logged in user, or an empty string if the
+	// client didn't log in yet
+	User() string
+
+	// RemoteIP returns the IP address of the client
+	RemoteIP() string
+
+	// SessionID returns a random id that identifies the client connection
+	SessionID() string
+
+	// Driver returns the FTPDriver that serves the client
+	Driver() FTPDriver
+
+	// BuildPath turns a path sent by the client into an absolute path as the
+	// client sees it, relative to the current directory
+	BuildPath(string) string
+
+	// DriverPath maps a path returned by BuildPath to the path that is handed
+	// to the driver, which is inside the root directory of the user
+	DriverPath(string) string
+
+	// Permitted returns true if the logged in user has a permission for a
+	// path returned by BuildPath
+	Permitted(FTPPermission, string) bool
+
+	// WriteMessage sends a single line reply to the client
+	WriteMessage(int, string) error
+
+	// WriteLines sends a multiline reply to the client. The first and the
+	// last line must start with the code, like "211-Status:" and "211 End".
+	WriteLines(int, ...string) error
+
+	// RateLimiters returns the upload and download limiters of the client
+	// connection. Use them to change the limits of the session while it is
+	// connected. The limiters of its user are returned by
+	// FTPServer.UserRateLimiters().
+	RateLimiters() (upload *RateLimiter, download *RateLimiter)
+
+	// LastReplyCode returns the code of the first reply sent to the client
+	// for the command that is executing, or 0 if there was none. The
+	// replies of transfers that finish in the background don't count, so
+	// after a command like RETR it is the code of the 150 reply.
+	LastReplyCode() int
+
+	// HasDataConnection returns true if the client opened a data connection
+	// with PASV, EPSV, PORT or EPRT that wasn't used by a transfer yet. Check
+	// it before replying 150 to a command that transfers data, and reply 425
+	// without one.
+	HasDataConnection() bool
+
+	// SendData sends the data of reader to the client over the data
+	// connection it opened with PASV, EPSV, PORT or EPRT. Check
+	// HasDataConnection() and reply 150 first, SendData replies 425 itself
+	// if there is no data connection.
+	// The transfer runs in the background like RETR, and graval replies 226
+	// when it completed or 426 when the client aborted it. path describes
+	// the transfer in STAT replies. A reader that is an io.Closer is closed
+	// when the transfer ended.
+	SendData(path string, reader io.Reader)
+
+	// ReceiveData hands the data the client sends over its data connection
+	// to fn, which runs in the background like STOR. Check
+	// HasDataConnection() and reply 150 first. graval replies 226 when fn
+	// returns nil, 426 when the client aborted the transfer and 451 when fn
+	// returns an error, which is logged.
+	ReceiveData(path string, fn func(io.Reader) error)
+}
+
+// FTPInterceptor wraps the execution of every command a client sends, to
+// audit, limit or veto commands centrally. It is called with the verb and
+// the parameter of the command, which is the password for PASS. Calling next
+// continues with the next interceptor and finally executes the command,
+// after which session.LastReplyCode() tells how the command was answered, or
+// is 0 if it wasn't.
+// An interceptor that doesn't call next has to reply to the client itself.
+type FTPInterceptor func(session FTPSession, verb string, param string, next func() error) error
+
+// FTPCommand handles a command sent by a client. Applications register them
+// with FTPServerOpts.Commands, or as SITE subcommands with
+// FTPServerOpts.SiteCommands.
+type FTPCommand interface {
+	// RequireParam returns true if the command needs a parameter. Clients
+	// that don't send one get an error reply without calling Execute.
+	RequireParam() bool
+
+	// RequireAuth returns true if the client must be logged in to use the
+	// command
+	RequireAuth() bool
+
+	// Syntax describes the parameters of the command for HELP, like
+	// "<path>". Optional parameters are in brackets.
+	Syntax() string
+
+	// Execute runs the command with the parameter sent by the client. It is
+	// expected to reply to the client. Returned errors are logged.
+	Execute(FTPSession, string) error
+}
+
+func (ftpConn *ftpConn) User() string {
+	return ftpConn.user
+}
+
+func (ftpConn *ftpConn) RemoteIP() string {
+	return ftpConn.remoteIP()
+}
+
+func (ftpConn *ftpConn) SessionID() string {
+	return ftpConn.sessionId
+}
+
+func (ftpConn *ftpConn) Driver() FTPDriver {
+	return ftpConn.driver
+}
+
+func (ftpConn *ftpConn) BuildPath(filename string) string {
+	return ftpConn.buildPath(filename)
+}
+
+func (ftpConn *ftpConn) DriverPath(clientPath string) string {
+	return ftpConn.driverPath(clientPath)
+}
+
+func (ftpConn *ftpConn) Permitted(perm FTPPermission, path string) bool {
+	return ftpConn.permitted(perm, path)
+}
+
+func (ftpConn *ftpConn) WriteMessage(code int, message string) error {
+	_, err := ftpConn.writeMessage(code, message)
+	return err
+}
+
+func (ftpConn *ftpConn) WriteLines(code int, lines ...string) error {
+	_, err := ftpConn.writeLines(code, lines...)
+	return err
+}
+
+func (ftpConn *ftpConn) RateLimiters() (upload *RateLimiter, download *RateLimiter) {
+	return ftpConn.sessionLimits.upload, ftpConn.sessionLimits.download
+}
+
+func (ftpConn *ftpConn) LastReplyCode() int {
+	ftpConn.writeMu.Lock()
+	defer ftpConn.writeMu.Unlock()
+	return ftpConn.replyCode
+}
+
+func (ftpConn *ftpConn) HasDataConnection() bool {
+	return ftpConn.dataConn != nil
+}
+
+func (ftpConn *ftpConn) SendData(path string, reader io.Reader) {
+	closer, _ := reader.(io.Closer)
+	if ftpConn.dataConn == nil && closer != nil {
+		// startTransfer tells the client, but there won't be a transfer that
+		// closes the reader
+		closer.Close()
+	}
+
+	ftpConn.startTransfer(ftpConn.command, path, func(transfer *ftpTransfer) error {
+		if closer != nil {
+			defer closer.Close()
+		}
+		return ftpConn.sendOutOfBandReader(transfer, reader)
+	})
+}
+
+func (ftpConn *ftpConn) ReceiveData(path string, fn func(io.Reader) error) {
+	ftpConn.startTransfer(ftpConn.command, path, func(transfer *ftpTransfer) error {
+		err := fn(transfer.countingReader(ftpConn.uploadReader(transfer.dataConn)))
+		if transfer.isAborted() {
+			_, err := ftpConn.writeTransferMessage(426, "Connection closed; transfer aborted.")
+			return err
+		}
+		if err != nil {
+			var errs error
+			errs = multierror.Append(errs, err)
+			if _, err := ftpConn.writeTransferMessage(451, "Requested action aborted: local error in processing"); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+			return errs
+		}
+		_, err = ftpConn.writeTransferMessage(226, "Transfer complete.")
+		return err
+	})
+}
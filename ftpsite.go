@@ -0,0 +1,101 @@
+package graval
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// FTPSiteCommandDriver is an optional interface that an FTPDriver can
+// implement to provide SITE subcommands for its clients, in addition to the
+// ones of the server. They are keyed by their name, like "SYMLINK", and
+// replace server subcommands with the same name.
+type FTPSiteCommandDriver interface {
+	SiteCommands() map[string]FTPCommand
+}
+
+// defaultSiteCommands are the SITE subcommands every server provides.
+// SITE HELP is handled by commandSite itself.
+var defaultSiteCommands = map[string]FTPCommand{
+	"CHMOD": siteChmod{},
+}
+
+// newSiteCommands merges the default SITE subcommands with the ones of an
+// application, which win over the defaults
+func newSiteCommands(custom map[string]FTPCommand) map[string]FTPCommand {
+	siteCommands := make(map[string]FTPCommand, len(defaultSiteCommands)+len(custom))
+	for name, command := range defaultSiteCommands {
+		siteCommands[name] = command
+	}
+	for name, command := range custom {
+		siteCommands[strings.ToUpper(name)] = command
+	}
+	return siteCommands
+}
+
+// siteChmod responds to SITE CHMOD. It allows the client to change the mode
+// of a file or directory, if the driver implements FTPChmodDriver.
+type siteChmod struct{}
+
+func (cmd siteChmod) RequireParam() bool {
+	return true
+}
+
+func (cmd siteChmod) RequireAuth() bool {
+	return true
+}
+
+func (cmd siteChmod) Syntax() string {
+	return "<mode> <path>"
+}
+
+func (cmd siteChmod) Execute(session FTPSession, param string) error {
+	driver, ok := session.Driver().(FTPChmodDriver)
+	if !ok {
+		return session.WriteMessage(502, "SITE CHMOD is not supported")
+	}
+
+	parts := strings.SplitN(param, " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return session.WriteMessage(501, "Syntax: SITE CHMOD <mode> <path>")
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil || mode > 07777 {
+		return session.WriteMessage(501, "Invalid mode "+parts[0])
+	}
+
+	path := session.BuildPath(strings.TrimSpace(parts[1]))
+	if !session.Permitted(PermChmod, path) {
+		return session.WriteMessage(550, "Permission denied")
+	}
+
+	if err := driver.Chmod(session.DriverPath(path), chmodFileMode(mode)); err != nil {
+		var errs error
+		errs = multierror.Append(errs, fmt.Errorf("failed to execute SITE CHMOD path: %s - %w", path, err))
+		if err := session.WriteMessage(550, "Could not change mode"); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		return errs
+	}
+	return session.WriteMessage(200, "SITE CHMOD command successful")
+}
+
+// chmodFileMode turns a mode in the octal notation of chmod into an
+// os.FileMode. Go keeps the setuid, setgid and sticky bits apart from the
+// permission bits, so os.Chmod would ignore them otherwise.
+func chmodFileMode(mode uint64) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
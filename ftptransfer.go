@@ -0,0 +1,134 @@
+package graval
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTransferAborted is passed to FTPUploadAbortDriver.AbortUpload when the
+// client aborted an upload with ABOR or disconnected while it was running.
+var ErrTransferAborted = errors.New("transfer aborted")
+
+// ftpTransfer tracks a data transfer that runs in its own goroutine, so the
+// control connection can keep processing commands like ABOR meanwhile. The
+// transfer owns its data connection and closes it when it finished.
+type ftpTransfer struct {
+	// the number of bytes transferred so far, accessed atomically
+	bytes    int64
+	command  string
+	path     string
+	started  time.Time
+	dataConn ftpDataSocket
+	mu       sync.Mutex
+	aborted  bool
+	done     chan struct{}
+}
+
+func newFtpTransfer(command string, path string, dataConn ftpDataSocket) *ftpTransfer {
+	transfer := new(ftpTransfer)
+	transfer.command = command
+	transfer.path = path
+	transfer.started = time.Now()
+	transfer.dataConn = dataConn
+	transfer.done = make(chan struct{})
+	return transfer
+}
+
+// abort marks the transfer as aborted and closes its data connection, which
+// makes the transfer stop.
+func (transfer *ftpTransfer) abort() {
+	transfer.mu.Lock()
+	transfer.aborted = true
+	transfer.mu.Unlock()
+	// errors are expected, the transfer may have closed the connection
+	// already
+	transfer.dataConn.Close()
+}
+
+// isAborted returns true if the transfer was aborted
+func (transfer *ftpTransfer) isAborted() bool {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.aborted
+}
+
+// wait blocks until the transfer finished and sent its final reply
+func (transfer *ftpTransfer) wait() {
+	<-transfer.done
+}
+
+// progress returns how many bytes were transferred so far
+func (transfer *ftpTransfer) progress() int64 {
+	return atomic.LoadInt64(&transfer.bytes)
+}
+
+// countingReader counts the bytes read from reader as the progress of the
+// transfer
+func (transfer *ftpTransfer) countingReader(reader io.Reader) io.Reader {
+	return &transferCountingReader{reader: reader, transfer: transfer}
+}
+
+type transferCountingReader struct {
+	reader   io.Reader
+	transfer *ftpTransfer
+}
+
+func (r *transferCountingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.transfer.bytes, int64(n))
+	return n, err
+}
+
+// stripTelnet removes Telnet commands from a line received on the control
+// connection. Clients send "Interrupt Process" and "Synch" sequences before
+// ABOR, as described in RFC 959, and those must not end up in the command.
+// BSD clients send the IAC of the Synch as urgent data, which the socket
+// drops, so a lone Data Mark byte is left in front of the command. Commands
+// are ASCII, so any other bytes in front of them are dropped as well.
+func stripTelnet(line string) string {
+	const (
+		iac  = 255
+		will = 251
+		dont = 254
+	)
+	if strings.IndexByte(line, iac) < 0 {
+		return trimNonASCIIPrefix(line)
+	}
+
+	stripped := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		if line[i] != iac {
+			stripped = append(stripped, line[i])
+			continue
+		}
+		if i+1 >= len(line) {
+			break
+		}
+		switch next := line[i+1]; {
+		case next == iac:
+			// an escaped 255 data byte
+			stripped = append(stripped, iac)
+			i++
+		case next >= will && next <= dont:
+			// option negotiation takes another byte
+			i += 2
+		default:
+			i++
+		}
+	}
+	return trimNonASCIIPrefix(string(stripped))
+}
+
+// trimNonASCIIPrefix removes the bytes outside of ASCII from the start of line
+func trimNonASCIIPrefix(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] < 0x80 {
+			return line[i:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestStripTelnet(t *testing.T) {
+	Convey("Stripping Telnet commands from a line", t, func() {
+		Convey("Will leave plain lines unchanged", func() {
+			So(stripTelnet("ABOR\r\n"), ShouldEqual, "ABOR\r\n")
+		})
+
+		Convey("Will remove Interrupt Process and Synch", func() {
+			So(stripTelnet("\xff\xf4\xff\xf2ABOR\r\n"), ShouldEqual, "ABOR\r\n")
+		})
+
+		Convey("Will remove the Data Mark left by an urgent Synch", func() {
+			So(stripTelnet("\xff\xf4\xf2ABOR\r\n"), ShouldEqual, "ABOR\r\n")
+			So(stripTelnet("\xf2ABOR\r\n"), ShouldEqual, "ABOR\r\n")
+		})
+
+		Convey("Will remove option negotiation", func() {
+			So(stripTelnet("\xff\xfd\x01NOOP\r\n"), ShouldEqual, "NOOP\r\n")
+		})
+
+		Convey("Will unescape data bytes", func() {
+			So(stripTelnet("RETR a\xff\xffb\r\n"), ShouldEqual, "RETR a\xffb\r\n")
+		})
+	})
+}
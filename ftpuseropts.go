@@ -0,0 +1,45 @@
+package graval
+
+// FTPUserOpts contains settings that apply to a single user. Drivers provide
+// them by implementing FTPUserOptsDriver, which graval consults right after
+// the user authenticated successfully.
+type FTPUserOpts struct {
+	// Restricts the addresses the user may log in from. Optional, defaults to
+	// nil which allows any address that the server allows.
+	IPFilter FTPIPFilterProvider
+
+	// The maximum number of simultaneous logged in sessions for the user.
+	// Optional, defaults to 0 which uses the MaxSessionsPerUser option of the
+	// server. A negative value means unlimited.
+	MaxSessions int
+
+	// The maximum size of a single uploaded file in bytes. Optional, defaults
+	// to 0 which uses the MaxUploadSize option of the server. A negative value
+	// means unlimited.
+	MaxUploadSize int64
+
+	// The directory on the driver that the user sees as "/". graval maps all
+	// paths from the client into it before calling the driver, so the user
+	// can never access anything outside of it. Optional, defaults to "" which
+	// passes paths to the driver unchanged.
+	Root string
+
+	// What the user is allowed to do. Optional, defaults to nil which allows
+	// everything and leaves all authorization to the driver.
+	Permissions *FTPPermissions
+
+	// The maximum number of bytes per second all sessions of the user
+	// together may upload and download. They are applied every time the user
+	// logs in, see FTPServer.UserRateLimiters(). Optional, defaults to 0 which
+	// means unlimited.
+	UploadRateLimit   int64
+	DownloadRateLimit int64
+}
+
+// FTPUserOptsDriver is an optional interface that an FTPDriver can implement
+// to provide per-user settings.
+type FTPUserOptsDriver interface {
+	// params  - username
+	// returns - the settings for the user, or nil to use the defaults
+	UserOpts(string) (*FTPUserOpts, error)
+}
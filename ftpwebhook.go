@@ -0,0 +1,301 @@
+package graval
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FTPWebhookOpts configures an FTPWebhookNotifier
+type FTPWebhookOpts struct {
+	// The URLs every event is posted to. This is a mandatory option.
+	URLs []string
+
+	// The types of events that are posted. Optional, defaults to
+	// EventUploadCompleted.
+	Events []FTPEventType
+
+	// Use this option to sign the payloads. The HMAC-SHA256 of the body is
+	// sent as hex in the X-Graval-Signature header, like "sha256=5d41...".
+	// Optional, defaults to no signature.
+	Secret string
+
+	// How often an event is posted to a URL before it is given up. Requests
+	// are retried after network errors, 429 and 5xx replies. Optional,
+	// defaults to 3.
+	MaxAttempts int
+
+	// How long to wait before the first retry. It doubles with every further
+	// retry. Optional, defaults to 1 second.
+	RetryDelay time.Duration
+
+	// The upper bound for the delay between retries. Optional, defaults to
+	// 30 seconds.
+	MaxRetryDelay time.Duration
+
+	// The number of events that may wait to be posted to each URL. Events
+	// that arrive while the queue of a URL is full are dropped for that URL,
+	// so slow endpoints never stall the client sessions or the other URLs.
+	// Optional, defaults to 100.
+	QueueSize int
+
+	// How long a single request may take. Optional, defaults to 10 seconds.
+	// It is ignored when Client is set.
+	Timeout time.Duration
+
+	// The client used for the requests. Optional, defaults to a client with
+	// Timeout.
+	Client *http.Client
+
+	// The logger for events that couldn't be delivered. Optional.
+	Logger FTPLogger
+}
+
+// FTPWebhookNotifier is an FTPNotifier that posts events as JSON to HTTP
+// endpoints, e.g. to start processing a file when its upload completed.
+// Every URL has its own queue, and the events are posted to it in the
+// background.
+//
+// Always use NewFTPWebhookNotifier() to create a new FTPWebhookNotifier, and
+// Close() it when the server stopped.
+type FTPWebhookNotifier struct {
+	opts      FTPWebhookOpts
+	events    map[FTPEventType]bool
+	endpoints []*webhookEndpoint
+	mu        sync.RWMutex
+	closed    bool
+	// ctx is canceled when Close gives up waiting for the queued events
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// webhookEndpoint is a URL and the events waiting to be posted to it
+type webhookEndpoint struct {
+	url   string
+	queue chan webhookDelivery
+}
+
+// webhookDelivery is an encoded event waiting to be posted
+type webhookDelivery struct {
+	eventType FTPEventType
+	path      string
+	body      []byte
+}
+
+// webhookPayload is the JSON body that is posted for an event
+type webhookPayload struct {
+	Type       FTPEventType `json:"type"`
+	Time       time.Time    `json:"time"`
+	SessionID  string       `json:"session_id"`
+	RemoteIP   string       `json:"remote_ip"`
+	User       string       `json:"user,omitempty"`
+	Path       string       `json:"path,omitempty"`
+	FromPath   string       `json:"from_path,omitempty"`
+	Bytes      int64        `json:"bytes"`
+	DurationMs int64        `json:"duration_ms"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// NewFTPWebhookNotifier creates a notifier and starts posting the events it
+// receives. Pass it to the server with FTPServerOpts.Notifier.
+func NewFTPWebhookNotifier(opts *FTPWebhookOpts) *FTPWebhookNotifier {
+	notifier := new(FTPWebhookNotifier)
+	notifier.opts = *opts
+	if notifier.opts.MaxAttempts <= 0 {
+		notifier.opts.MaxAttempts = 3
+	}
+	if notifier.opts.RetryDelay <= 0 {
+		notifier.opts.RetryDelay = time.Second
+	}
+	if notifier.opts.MaxRetryDelay <= 0 {
+		notifier.opts.MaxRetryDelay = 30 * time.Second
+	}
+	if notifier.opts.QueueSize <= 0 {
+		notifier.opts.QueueSize = 100
+	}
+	if notifier.opts.Timeout <= 0 {
+		notifier.opts.Timeout = 10 * time.Second
+	}
+	if notifier.opts.Client == nil {
+		notifier.opts.Client = &http.Client{Timeout: notifier.opts.Timeout}
+	}
+
+	events := opts.Events
+	if len(events) == 0 {
+		events = []FTPEventType{EventUploadCompleted}
+	}
+	notifier.events = make(map[FTPEventType]bool, len(events))
+	for _, eventType := range events {
+		notifier.events[eventType] = true
+	}
+
+	notifier.ctx, notifier.cancel = context.WithCancel(context.Background())
+	for _, url := range notifier.opts.URLs {
+		endpoint := &webhookEndpoint{url: url, queue: make(chan webhookDelivery, notifier.opts.QueueSize)}
+		notifier.endpoints = append(notifier.endpoints, endpoint)
+		notifier.workers.Add(1)
+		go notifier.run(endpoint)
+	}
+	return notifier
+}
+
+// Notify queues an event to be posted to every URL. It never blocks, events
+// are dropped when the queue of a URL is full or the notifier was closed.
+func (notifier *FTPWebhookNotifier) Notify(event FTPEvent) {
+	if !notifier.events[event.Type] {
+		return
+	}
+
+	body, err := json.Marshal(newWebhookPayload(event))
+	if err != nil {
+		if notifier.opts.Logger != nil {
+			notifier.opts.Logger.Warnf("failed to encode %s event %v", event.Type, err)
+		}
+		return
+	}
+	delivery := webhookDelivery{eventType: event.Type, path: event.Path, body: body}
+
+	notifier.mu.RLock()
+	defer notifier.mu.RUnlock()
+	if notifier.closed {
+		return
+	}
+	for _, endpoint := range notifier.endpoints {
+		select {
+		case endpoint.queue <- delivery:
+		default:
+			if notifier.opts.Logger != nil {
+				notifier.opts.Logger.Warnf("webhook queue for %s is full, dropping %s event for %s", endpoint.url, event.Type, event.Path)
+			}
+		}
+	}
+}
+
+// Close stops accepting events and waits until the queued ones were posted.
+// When ctx is done first, the requests in flight are canceled, the events
+// still queued are dropped and ctx.Err() is returned.
+func (notifier *FTPWebhookNotifier) Close(ctx context.Context) error {
+	notifier.mu.Lock()
+	if !notifier.closed {
+		notifier.closed = true
+		for _, endpoint := range notifier.endpoints {
+			close(endpoint.queue)
+		}
+	}
+	notifier.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		notifier.workers.Wait()
+		close(done)
+	}()
+	defer notifier.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run posts the events queued for endpoint until the notifier is closed
+func (notifier *FTPWebhookNotifier) run(endpoint *webhookEndpoint) {
+	defer notifier.workers.Done()
+	for delivery := range endpoint.queue {
+		if notifier.ctx.Err() != nil {
+			// Close gave up waiting, drop what is left
+			continue
+		}
+		if err := notifier.deliver(endpoint.url, delivery.eventType, delivery.body); err != nil && notifier.opts.Logger != nil {
+			notifier.opts.Logger.Warnf("failed to post %s event for %s to %s %v", delivery.eventType, delivery.path, endpoint.url, err)
+		}
+	}
+}
+
+// deliver posts body to url, retrying with backoff until it succeeds, the
+// attempts are used up or the notifier gave up waiting in Close
+func (notifier *FTPWebhookNotifier) deliver(url string, eventType FTPEventType, body []byte) error {
+	delay := notifier.opts.RetryDelay
+	var err error
+	for attempt := 1; attempt <= notifier.opts.MaxAttempts; attempt++ {
+		var retry bool
+		if retry, err = notifier.post(url, eventType, body); err == nil || !retry {
+			return err
+		}
+
+		if attempt < notifier.opts.MaxAttempts {
+			select {
+			case <-time.After(delay):
+			case <-notifier.ctx.Done():
+				return notifier.ctx.Err()
+			}
+			if delay *= 2; delay > notifier.opts.MaxRetryDelay {
+				delay = notifier.opts.MaxRetryDelay
+			}
+		}
+	}
+	return err
+}
+
+// post sends a single request. retry tells whether a failed request may
+// succeed when it is sent again.
+func (notifier *FTPWebhookNotifier) post(url string, eventType FTPEventType, body []byte) (retry bool, err error) {
+	request, err := http.NewRequestWithContext(notifier.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Graval-Event", string(eventType))
+	if notifier.opts.Secret != "" {
+		request.Header.Set("X-Graval-Signature", "sha256="+signWebhookPayload(notifier.opts.Secret, body))
+	}
+
+	response, err := notifier.opts.Client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	retry = response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %s", response.Status)
+}
+
+func newWebhookPayload(event FTPEvent) webhookPayload {
+	payload := webhookPayload{
+		Type:       event.Type,
+		Time:       event.Time.UTC(),
+		SessionID:  event.SessionID,
+		RemoteIP:   event.RemoteIP,
+		User:       event.User,
+		Path:       event.Path,
+		FromPath:   event.FromPath,
+		Bytes:      event.Bytes,
+		DurationMs: event.Duration.Milliseconds(),
+	}
+	if event.Err != nil {
+		payload.Error = event.Err.Error()
+	}
+	return payload
+}
+
+// signWebhookPayload returns the HMAC-SHA256 of body as hex
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
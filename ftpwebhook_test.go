@@ -0,0 +1,156 @@
+package graval
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// webhookRequest is a request received by a test endpoint
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	upload := FTPEvent{
+		Type:      EventUploadCompleted,
+		Time:      time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC),
+		SessionID: "abc",
+		RemoteIP:  "127.0.0.1",
+		User:      "test",
+		Path:      "/upload.txt",
+		Bytes:     11,
+		Duration:  1500 * time.Millisecond,
+	}
+
+	Convey("A webhook notifier", t, func() {
+		requests := make(chan webhookRequest, 10)
+		var status int32 = http.StatusOK
+		// the number of requests that fail with 503 before status is used
+		var failures int32
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			body, _ := ioutil.ReadAll(r.Body)
+			code := int(atomic.LoadInt32(&status))
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				code = http.StatusServiceUnavailable
+			}
+			w.WriteHeader(code)
+			if code == http.StatusOK {
+				requests <- webhookRequest{header: r.Header, body: body}
+			}
+		}))
+		defer server.Close()
+
+		notifier := NewFTPWebhookNotifier(&FTPWebhookOpts{
+			URLs:       []string{server.URL},
+			Secret:     "secret",
+			RetryDelay: 10 * time.Millisecond,
+		})
+		defer notifier.Close(context.Background())
+
+		Convey("Will post completed uploads as signed JSON", func() {
+			notifier.Notify(upload)
+			request := <-requests
+			So(request.header.Get("Content-Type"), ShouldEqual, "application/json")
+			So(request.header.Get("X-Graval-Event"), ShouldEqual, "upload_completed")
+			So(request.header.Get("X-Graval-Signature"), ShouldEqual, "sha256="+signWebhookPayload("secret", request.body))
+
+			var payload map[string]interface{}
+			So(json.Unmarshal(request.body, &payload), ShouldBeNil)
+			So(payload["type"], ShouldEqual, "upload_completed")
+			So(payload["path"], ShouldEqual, "/upload.txt")
+			So(payload["user"], ShouldEqual, "test")
+			So(payload["bytes"], ShouldEqual, 11)
+			So(payload["duration_ms"], ShouldEqual, 1500)
+			So(payload["time"], ShouldEqual, "2020-01-02T15:04:05Z")
+		})
+
+		Convey("Will ignore other events", func() {
+			notifier.Notify(FTPEvent{Type: EventDeleted, Path: "/upload.txt"})
+			So(notifier.Close(context.Background()), ShouldBeNil)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 0)
+		})
+
+		Convey("Will retry after server errors", func() {
+			atomic.StoreInt32(&failures, 2)
+			notifier.Notify(upload)
+			request := <-requests
+			So(string(request.body), ShouldContainSubstring, "/upload.txt")
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 3)
+		})
+
+		Convey("Will not retry after client errors", func() {
+			atomic.StoreInt32(&status, http.StatusBadRequest)
+			notifier.Notify(upload)
+			So(notifier.Close(context.Background()), ShouldBeNil)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 1)
+		})
+	})
+
+	Convey("A webhook notifier with a slow endpoint", t, func() {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+
+		notifier := NewFTPWebhookNotifier(&FTPWebhookOpts{URLs: []string{server.URL}, QueueSize: 2})
+
+		Convey("Will not block when its queue is full", func() {
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				notifier.Notify(upload)
+			}
+			So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+			close(release)
+			So(notifier.Close(context.Background()), ShouldBeNil)
+		})
+
+		Convey("Will give up waiting when the context of Close is done", func() {
+			defer close(release)
+			notifier.Notify(upload)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			So(notifier.Close(ctx), ShouldResemble, context.DeadlineExceeded)
+		})
+	})
+
+	Convey("A webhook notifier with a slow and a fast endpoint", t, func() {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer slow.Close()
+		requests := make(chan struct{}, 10)
+		fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- struct{}{}
+		}))
+		defer fast.Close()
+
+		notifier := NewFTPWebhookNotifier(&FTPWebhookOpts{URLs: []string{slow.URL, fast.URL}})
+		defer notifier.Close(context.Background())
+		defer close(release)
+
+		Convey("Will post to the fast endpoint without waiting for the slow one", func() {
+			notifier.Notify(upload)
+			notifier.Notify(upload)
+			for i := 0; i < 2; i++ {
+				select {
+				case <-requests:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the fast endpoint did not receive the event")
+				}
+			}
+		})
+	})
+}
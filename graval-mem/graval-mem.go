@@ -118,7 +118,7 @@ func main() {
 	}
 	ftpServer := graval.NewFTPServer(opts)
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	signal.Notify(c, os.Interrupt, syscall.SIGQUIT)
 	go func() {